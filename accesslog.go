@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Access log file which can be reopened after being moved away by logrotate
+type reopenableFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openReopenableFile(path string) (*reopenableFile, error) {
+	f := &reopenableFile{path: path}
+	if err := f.Reopen(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *reopenableFile) Reopen() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	return nil
+}
+
+func (f *reopenableFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Write(p)
+}
+
+func (f *reopenableFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Sync()
+}
+
+// Returns logger writing newline-delimited JSON into given file
+func newFileLogger(file *reopenableFile) *zap.Logger {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), file, zap.InfoLevel))
+}
+
+// Remembers response status and size for access logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.size += n
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Logs every request once it's done. Nil accessLogger logs through the global logger
+func accessLogMiddleware(accessLogger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			log := accessLogger
+			if log == nil {
+				log = zap.L()
+			}
+			fields := []zap.Field{
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.RequestURI()),
+				zap.Int("status", recorder.status),
+				zap.Int("size", recorder.size),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("remoteAddr", clientIP(r)),
+				zap.String("userAgent", r.UserAgent()),
+			}
+			if requestID, ok := requestIDFromContext(r.Context()); ok {
+				fields = append(fields, zap.String("requestID", requestID))
+			}
+			log.Info("request handled", fields...)
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Guards admin endpoints with the configured API key, passed either as "Authorization: Bearer <key>"
+// or "X-API-Key: <key>". Admin endpoints are unavailable when no key is configured
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.RestAPI.AdminAPIKey == "" {
+			writeResponse(w, http.StatusForbidden, "admin api is disabled")
+			return
+		}
+
+		key := r.Header.Get("X-API-Key")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(key), []byte(config.RestAPI.AdminAPIKey)) != 1 {
+			writeResponse(w, http.StatusUnauthorized, "invalid api key")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Body of batch requests, e.g. {"operations": [{"op": "votes", "params": {"limit": "10"}}, {"op": "stats"}]}
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchOperation struct {
+	Op     string            `json:"op"`
+	Key    string            `json:"key"` // Key of the result, defaults to op
+	Params map[string]string `json:"params"`
+}
+
+// Result of a single batch operation, same as a standalone response along with its HTTP status
+type BatchResult struct {
+	Status string      `json:"status"`
+	Code   int         `json:"code"`
+	Data   interface{} `json:"data"`
+}
+
+// Operations allowed in batches mapped to their handlers. Disabled endpoints are left out
+func (e *Endpoints) batchHandlers() map[string]http.HandlerFunc {
+	handlers := map[string]http.HandlerFunc{}
+	if config.Endpoints.Votes {
+		handlers["votes"] = e.HandleVoters
+	}
+	if config.Endpoints.Staff {
+		handlers["staff"] = e.HandleStaff
+	}
+	if config.Endpoints.Votes && config.Endpoints.Staff {
+		handlers["stats"] = e.HandleStats
+	}
+	return handlers
+}
+
+// Query parameters that change how responses are encoded. Results of batch operations are always
+// enveloped JSON, so these are rejected instead of failing to decode the response
+var batchRejectedParams = []string{"format", "envelope"}
+
+// Returns why operation's parameters can't be used in a batch, or an empty string if they can
+func checkBatchParams(params map[string]string) string {
+	for _, param := range batchRejectedParams {
+		if _, ok := params[param]; ok {
+			return fmt.Sprintf("%s is not supported in batch operations, results are always JSON", param)
+		}
+	}
+	return ""
+}
+
+// Runs multiple read operations concurrently under a shared timeout and responds with their results
+// keyed by operation key. Failing operations don't fail the whole batch, but have an error status
+func (e *Endpoints) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
+
+	var request batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); isBodyTooLarge(err) {
+		writeResponse(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	} else if err != nil {
+		writeResponse(w, http.StatusBadRequest, "invalid batch request body")
+		return
+	}
+
+	if len(request.Operations) == 0 {
+		writeResponse(w, http.StatusBadRequest, "no operations given")
+		return
+	} else if len(request.Operations) > config.RestAPI.MaxBatchOperations {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("too many operations, at most %d allowed", config.RestAPI.MaxBatchOperations))
+		return
+	}
+
+	handlers := e.batchHandlers()
+	keys := map[string]bool{}
+	// Invalid parameters fail only their own operation, like errors of its endpoint would
+	rejected := map[string]BatchResult{}
+	for i, operation := range request.Operations {
+		if _, ok := handlers[operation.Op]; !ok {
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("unknown operation: %s", operation.Op))
+			return
+		}
+
+		if operation.Key == "" {
+			request.Operations[i].Key = operation.Op
+		}
+		if keys[request.Operations[i].Key] {
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("duplicate operation key: %s", request.Operations[i].Key))
+			return
+		}
+		keys[request.Operations[i].Key] = true
+
+		if message := checkBatchParams(operation.Params); message != "" {
+			rejected[request.Operations[i].Key] = BatchResult{Status: errorStatus, Code: http.StatusBadRequest, Data: message}
+		}
+	}
+
+	// Operations apply their own timeouts too, whichever ends first wins
+	timeout := config.RestAPI.VotersTimeout.Duration
+	if config.RestAPI.StaffTimeout.Duration > timeout {
+		timeout = config.RestAPI.StaffTimeout.Duration
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := rejected
+	for _, operation := range request.Operations {
+		if _, ok := rejected[operation.Key]; ok {
+			continue
+		}
+
+		wg.Add(1)
+		go func(operation batchOperation) {
+			defer wg.Done()
+			result := runBatchOperation(ctx, r, handlers[operation.Op], operation.Params)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[operation.Key] = result
+		}(operation)
+	}
+	wg.Wait()
+
+	writeResponse(w, http.StatusOK, results)
+}
+
+// Runs handler as if it was requested with given query parameters, always getting JSON back.
+// Operations run outside of recovery middleware, so panics are dealt with here, including
+// http.ErrAbortHandler of an aborted response
+func runBatchOperation(ctx context.Context, r *http.Request, handler http.HandlerFunc, params map[string]string) (result BatchResult) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		} else if recovered != http.ErrAbortHandler {
+			logger(ctx).Error("batch operation panicked",
+				zap.Any("panic", recovered),
+				zap.ByteString("stack", debug.Stack()))
+		}
+		result = failedBatchResult()
+	}()
+
+	query := url.Values{}
+	for key, value := range params {
+		query.Set(key, value)
+	}
+
+	opRequest := r.Clone(ctx)
+	opRequest.Method = http.MethodGet
+	opRequest.Body = http.NoBody
+	opRequest.ContentLength = 0
+	opRequest.URL.RawQuery = query.Encode()
+	opRequest.Header.Del("Accept")
+	opRequest.Header.Del("If-Modified-Since")
+
+	recorder := &batchResponseWriter{header: http.Header{}, status: http.StatusOK}
+	handler(recorder, opRequest)
+
+	if recorder.status == http.StatusNoContent {
+		return BatchResult{Status: okStatus, Code: recorder.status}
+	}
+
+	var response StatusResponse
+	if err := json.Unmarshal(recorder.body, &response); err != nil {
+		logger(ctx).Warn("failed to decode batch operation response", zap.Error(err))
+		return failedBatchResult()
+	}
+
+	return BatchResult{
+		Status: response.Status,
+		Code:   recorder.status,
+		Data:   response.Data,
+	}
+}
+
+func failedBatchResult() BatchResult {
+	return BatchResult{
+		Status: errorStatus,
+		Code:   http.StatusInternalServerError,
+		Data:   "failed to run operation",
+	}
+}
+
+// Collects response of a batch operation in memory
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   []byte
+}
+
+func (w *batchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *batchResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *batchResponseWriter) Write(p []byte) (int, error) {
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchBodyLimit(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.MaxBodySize = 64
+	config.RestAPI.MaxBatchOperations = 10
+
+	e, _ := newFakeEndpoints(t)
+	handler := requestSizeLimits(http.HandlerFunc(e.HandleBatch))
+	oversized := `{"operations": [` + strings.Repeat(`{"op": "votes"}, `, 10) + `{"op": "stats"}]}`
+
+	cases := []struct {
+		name          string
+		body          string
+		contentLength int64
+		status        int
+	}{
+		{"oversized with content length", oversized, int64(len(oversized)), http.StatusRequestEntityTooLarge},
+		// Chunked body is only caught while decoding it
+		{"oversized without content length", oversized, -1, http.StatusRequestEntityTooLarge},
+		{"invalid", `{"operations": `, -1, http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/batch", strings.NewReader(c.body))
+			r.ContentLength = c.contentLength
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != c.status {
+				t.Errorf("got status %d, expected %d", w.Code, c.status)
+			}
+		})
+	}
+}
+
+func TestBatchRejectsEncodingParams(t *testing.T) {
+	restoreConfig(t)
+	config.Endpoints.Votes = true
+	config.RestAPI.MaxBatchOperations = 10
+	config.RestAPI.VotersTimeout = duration{time.Second}
+
+	e, db := newFakeEndpoints(t)
+	db.answer("select count(*)", []string{"count(*)"}, row(int64(1)))
+	db.answer("select voter_name", voterColumns, voterRow("a", 1, 1590000000))
+
+	body := `{"operations": [
+		{"op": "votes", "key": "csv", "params": {"format": "csv"}},
+		{"op": "votes", "key": "raw", "params": {"envelope": "false"}},
+		{"op": "votes", "params": {"limit": "10"}}
+	]}`
+	w := httptest.NewRecorder()
+	e.HandleBatch(w, httptest.NewRequest("POST", "/api/v1/batch", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected 200: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Data map[string]BatchResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"csv": "format is not supported in batch operations, results are always JSON",
+		"raw": "envelope is not supported in batch operations, results are always JSON",
+	}
+	for key, message := range expected {
+		result := response.Data[key]
+		if result.Code != http.StatusBadRequest || result.Data != message {
+			t.Errorf("%s: got %d %v, expected 400 %q", key, result.Code, result.Data, message)
+		}
+	}
+	if result := response.Data["votes"]; result.Code != http.StatusOK {
+		t.Errorf("votes: got %d %v, expected 200", result.Code, result.Data)
+	}
+}
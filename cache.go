@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Simple in-memory cache for computed responses. Zero TTL disables caching. Cache keys may come from
+// client-controlled query parameters, so amount of entries is bounded by maxEntries, 0 meaning unbounded
+type responseCache struct {
+	name       string // Endpoint label of metrics
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.RWMutex
+	entries    map[string]cacheEntry
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newResponseCache(name string, ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		name:       name,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]cacheEntry{},
+	}
+}
+
+func (c *responseCache) Enabled() bool {
+	return c.ttl > 0
+}
+
+func (c *responseCache) Get(key string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		// Lookups of a disabled cache would only skew the hit rate
+		if c.Enabled() {
+			atomic.AddUint64(&c.misses, 1)
+		}
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return entry.value, true
+}
+
+// Returns how many lookups were served from the cache and how many were not
+func (c *responseCache) Stats() (hits uint64, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// Returns amount of entries which have not expired yet
+func (c *responseCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	count := 0
+	for _, entry := range c.entries {
+		if !now.After(entry.expires) {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *responseCache) Set(key string, value interface{}) {
+	if !c.Enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for entryKey, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, entryKey)
+		}
+	}
+
+	// All entries share the TTL, so the one expiring first is the oldest
+	if _, ok := c.entries[key]; !ok && c.maxEntries > 0 {
+		for len(c.entries) >= c.maxEntries {
+			var oldestKey string
+			oldest := now.Add(c.ttl)
+			for entryKey, entry := range c.entries {
+				if !entry.expires.After(oldest) {
+					oldestKey, oldest = entryKey, entry.expires
+				}
+			}
+			delete(c.entries, oldestKey)
+		}
+	}
+
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+// Removes all entries, returns how many were removed
+func (c *responseCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleared := len(c.entries)
+	c.entries = map[string]cacheEntry{}
+	return cleared
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheHitExpiryAndFlush(t *testing.T) {
+	cache := newResponseCache("test", 50*time.Millisecond, 0)
+
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("got a hit from empty cache")
+	}
+
+	cache.Set("key", "value")
+	if value, ok := cache.Get("key"); !ok || value != "value" {
+		t.Fatalf("got %v, %t, expected cached value", value, ok)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("got a hit for expired entry")
+	}
+
+	cache.Set("key", "value")
+	if cleared := cache.Flush(); cleared != 1 {
+		t.Errorf("flush cleared %d entries, expected 1", cleared)
+	}
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("got a hit after flush")
+	}
+
+	if hits, misses := cache.Stats(); hits != 1 || misses != 3 {
+		t.Errorf("got %d hits and %d misses, expected 1 and 3", hits, misses)
+	}
+}
+
+func TestResponseCacheDisabled(t *testing.T) {
+	cache := newResponseCache("test", 0, 0)
+	cache.Set("key", "value")
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("disabled cache returned a value")
+	}
+	if hits, misses := cache.Stats(); hits != 0 || misses != 0 {
+		t.Errorf("disabled cache counted %d hits and %d misses", hits, misses)
+	}
+}
+
+func TestResponseCacheDeletesExpiredOnSet(t *testing.T) {
+	cache := newResponseCache("test", 20*time.Millisecond, 0)
+	for i := 0; i < 10; i++ {
+		cache.Set(fmt.Sprint(i), i)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	cache.Set("fresh", true)
+	if count := len(cache.entries); count != 1 {
+		t.Errorf("cache holds %d entries, expected expired ones to be deleted", count)
+	}
+}
+
+func TestResponseCacheEvictsOldest(t *testing.T) {
+	cache := newResponseCache("test", time.Minute, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Set(key, key)
+		// Distinct expiry times regardless of clock resolution
+		time.Sleep(time.Millisecond)
+	}
+
+	// Replacing an existing entry evicts nothing
+	cache.Set("b", "b2")
+	if count := cache.Len(); count != 3 {
+		t.Fatalf("cache holds %d entries, expected 3", count)
+	}
+
+	cache.Set("d", "d")
+	if count := cache.Len(); count != 3 {
+		t.Fatalf("cache holds %d entries, expected 3", count)
+	}
+	if _, ok := cache.Get("a"); ok {
+		t.Error("oldest entry was not evicted")
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("entry %q was evicted", key)
+		}
+	}
+}
+
+func TestVotersCacheKeyDistinguishesParameters(t *testing.T) {
+	urls := []string{
+		"/api/v1/votes?limit=10",
+		"/api/v1/votes?limit=100",
+		"/api/v1/votes?limit=10&offset=10",
+		"/api/v1/votes?limit=10&search=a",
+		"/api/v1/votes?limit=10&min_votes=5",
+		"/api/v1/votes?limit=10&plain=true",
+	}
+
+	cache := newResponseCache("votes", time.Minute, 0)
+	for _, url := range urls {
+		query, err := parseVotersQuery(httptest.NewRequest("GET", url, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", url, err)
+		}
+		if _, ok := cache.Get(query.cacheKey()); ok {
+			t.Errorf("%s: got response cached for another request", url)
+		}
+		cache.Set(query.cacheKey(), url)
+	}
+
+	for _, url := range urls {
+		query, _ := parseVotersQuery(httptest.NewRequest("GET", url, nil))
+		if cached, ok := cache.Get(query.cacheKey()); !ok || cached != url {
+			t.Errorf("%s: got %v, expected its own cached response", url, cached)
+		}
+	}
+}
@@ -1,17 +1,172 @@
 package main
 
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var envPlaceholderRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
 type throneAPIConfig struct {
-	RestAPI  restAPIConfig        `toml:"rest_api"`
-	Database throneDatabaseConfig `toml:"database"`
+	RestAPI   restAPIConfig        `toml:"rest_api"`
+	Database  throneDatabaseConfig `toml:"database"`
+	Endpoints endpointsConfig      `toml:"endpoints"`
+	Logging   loggingConfig        `toml:"logging"`
+
+	// Overrides for color code hex values, e.g. c = "#E74C3C"
+	Colors map[string]string `toml:"colors"`
+
+	// Public names for LuckPerms groups, e.g. srmod = "senior_moderator". Unmapped groups keep their name
+	RankAliases map[string]string `toml:"rank_aliases"`
 }
 
 type restAPIConfig struct {
+	// TCP address like "127.0.0.1:8080" or Unix socket path like "unix:/run/throne-api.sock"
 	ListenAddress string `toml:"listen_address"`
 	CORSOrigins   string `toml:"cors_origin"`
+
+	// How long browsers may cache preflight responses, e.g. "10m". Unset leaves it up to the browser
+	CORSMaxAge duration `toml:"cors_max_age"`
+	// Allow credentialed requests. Browsers reject this together with "*" origin
+	CORSAllowCredentials bool `toml:"cors_allow_credentials"`
+
+	// Permissions of the Unix socket file in octal, defaults to "0660"
+	SocketMode string `toml:"socket_mode"`
+
+	// Requests per second allowed from a single client IP, 0 disables rate limiting
+	RateLimit      float64 `toml:"rate_limit"`
+	RateLimitBurst int     `toml:"rate_limit_burst"`
+
+	// Deprecated, same as listing loopback addresses and "unix" in trusted_proxies
+	TrustForwardedFor bool `toml:"trust_forwarded_for"`
+
+	// Reverse proxies (CIDR ranges or addresses) allowed to tell client IP in X-Forwarded-For or X-Real-IP.
+	// "unix" trusts peers connecting over the Unix socket of listen_address
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// Maximum amount of open client connections, 0 means unlimited. Further connections wait until
+	// one closes. Complements rate limiting by bounding file descriptors used
+	MaxConnections int `toml:"max_connections"`
+
+	// Time allowed for querying and processing data per request, e.g. "3s"
+	VotersTimeout duration `toml:"voters_timeout"`
+	StaffTimeout  duration `toml:"staff_timeout"`
+	// Time allowed for a single database query to return, excluding reading its rows. Unset leaves queries
+	// bound by the timeouts above only. Exceeding it is logged, telling slow database from slow processing
+	DBQueryTimeout duration `toml:"db_query_timeout"`
+
+	// Staff group titles and colors are given up this long before staff_timeout, responding with
+	// members only and "partial": true instead of timing out. Defaults to 500ms, 0 disables
+	PartialResponseMargin duration `toml:"partial_response_margin"`
+
+	// How long computed staff response is cached, unset disables caching. Without caching, HEAD requests
+	// for staff and votes only check the database and go without Content-Length and ETag
+	StaffCacheTTL duration `toml:"staff_cache_ttl"`
+	// How long stats response is cached, defaults to 30s. 0 disables caching
+	StatsCacheTTL duration `toml:"stats_cache_ttl"`
+	// How long votes are cached per distinct set of query parameters, unset disables caching
+	VotersCacheTTL duration `toml:"voters_cache_ttl"`
+	// Maximum amount of entries kept per cache, oldest ones are evicted first. Defaults to 1000, 0 means unlimited
+	CacheMaxEntries int `toml:"cache_max_entries"`
+	// Cache-Control header of successful staff and votes responses, e.g. "public, max-age=60" to let
+	// CDNs and browsers cache them. Defaults to "no-store", as do all other responses
+	StaffCacheControl string `toml:"staff_cache_control"`
+	VotesCacheControl string `toml:"votes_cache_control"`
+
+	// Query staff once at startup to populate the cache
+	WarmupOnStart bool `toml:"warmup_on_start"`
+
+	// Limit applied to votes endpoint when "limit" is not given, 0 means unlimited
+	DefaultVotersLimit int `toml:"default_voters_limit"`
+	// Upper bound for votes endpoint limit, larger (and default) limits are clamped to it. 0 means unlimited
+	MaxVotersLimit int `toml:"max_voters_limit"`
+
+	// Longer URLs are rejected with 414 and larger bodies with 413, 0 means unlimited
+	MaxURLLength int   `toml:"max_url_length"`
+	MaxBodySize  int64 `toml:"max_body_size"`
+
+	// Staff group member lists are cut off after this many members, 0 means unlimited
+	MaxMembersPerGroup int `toml:"max_members_per_group"`
+
+	// Maximum amount of names accepted by batch player lookup
+	MaxBatchPlayers int `toml:"max_batch_players"`
+	// Maximum amount of operations in a single batch request
+	MaxBatchOperations int `toml:"max_batch_operations"`
+
+	// Maximum amount of expensive staff and player queries running at once, 0 means unlimited. Requests
+	// which don't get to run one before their timeout are rejected with 503
+	MaxConcurrentQueries int `toml:"max_concurrent_queries"`
+
+	// Database queries taking longer than this are logged, unset disables logging
+	SlowQueryThreshold duration `toml:"slow_query_threshold"`
+	// Include bound parameters (player and group names) in slow query logs instead of just their count
+	SlowQueryLogArgs bool `toml:"slow_query_log_args"`
+	// Log SQL of every query at debug level, requires logging level to be debug
+	LogQueries bool `toml:"log_queries"`
+
+	// IANA timezone name used for human-readable timestamps, e.g. "Europe/Tallinn". Defaults to UTC
+	DisplayTimezone string `toml:"display_timezone"`
+
+	// Reject requests with unknown query parameters instead of ignoring them
+	StrictQueryParams bool `toml:"strict_query_params"`
+
+	// File receiving access logs as newline-delimited JSON, reopened on SIGHUP. Unset logs requests with the main logger
+	AccessLogPath string `toml:"access_log_path"`
+
+	// Answer with 500 and log the stack trace when a handler panics, instead of dropping the connection. On by default
+	RecoverPanics bool `toml:"recover_panics"`
+
+	// Directory with a single-page frontend to serve outside of /api, unknown paths get its index.html
+	StaticDir string `toml:"static_dir"`
+
+	// How response data consisting of an empty list or object (e.g. no voters, no staff groups) is
+	// serialized. Unset keeps data as the endpoint builds it, usually [] or {}. "null" gives "data": null,
+	// "empty" always gives [] or {} and "omit" leaves "data" out of the response. Only data itself is
+	// affected, not lists nested in it
+	EmptyData string `toml:"empty_data"`
+	// Answer with 204 and no body instead when data is an empty list or object. Takes precedence over empty_data
+	EmptyAs204 bool `toml:"empty_as_204"`
+
+	// URL of voter avatars with {uuid} standing for player UUID, e.g. "https://crafatar.com/avatars/{uuid}".
+	// Requires benjiauth_uuid_column, voters get no avatar_url otherwise
+	AvatarURLTemplate string `toml:"avatar_url_template"`
+
+	// Vote counts rewarded by the server, e.g. [100, 500, 1000]. When set, voters and players get the
+	// next milestone and votes missing from it
+	VoteMilestones []int `toml:"vote_milestones"`
+
+	// Indent JSON responses, handy when debugging with curl
+	DebugPretty bool `toml:"debug_pretty"`
+
+	// Key required by admin endpoints, unset disables them
+	AdminAPIKey string `toml:"admin_api_key"`
+}
+
+type loggingConfig struct {
+	// One of debug, info, warn or error
+	Level string `toml:"level"`
+	// Human-readable console output instead of JSON
+	Development bool `toml:"development"`
+}
+
+// Toggles for public endpoint groups, all enabled by default
+type endpointsConfig struct {
+	Votes   bool `toml:"votes"`   // votes and votes summary
+	Staff   bool `toml:"staff"`   // staff listing and groups
+	Player  bool `toml:"player"`  // player lookups and ranks
+	OpenAPI bool `toml:"openapi"` // OpenAPI spec
 }
 
 type throneDatabaseConfig struct {
 	DatabaseURL             string   `toml:"database_url"`
+	DatabasePasswordFile    string   `toml:"database_password_file"`
+	ReadDatabaseURL         string   `toml:"read_database_url"`
 	LuckPermsDatabaseName   string   `toml:"luckperms_database_name"`
 	LuckPermsTablePrefix    string   `toml:"luckperms_table_prefix"`
 	ConfettiDatabaseName    string   `toml:"confetti_database_name"`
@@ -19,4 +174,189 @@ type throneDatabaseConfig struct {
 	StaffGroupNames         []string `toml:"staff_group_names"`
 	BenjiAuthDatabaseName   string   `toml:"benjiauth_database_name"`
 	BenjiAuthUsersTableName string   `toml:"benjiauth_users_table_name"`
+
+	// Where original casing of usernames comes from: "benjiauth" (default), "authme" or "luckperms",
+	// which keeps lowercase LuckPerms usernames as they are
+	UsernameSource string `toml:"username_source"`
+
+	// AuthMe table used with "authme" username source, columns default to AuthMe's own defaults
+	AuthMeDatabaseName   string `toml:"authme_database_name"`
+	AuthMeTableName      string `toml:"authme_table_name"`
+	AuthMeNameColumn     string `toml:"authme_name_column"`
+	AuthMeRealNameColumn string `toml:"authme_realname_column"`
+
+	// Column of BenjiAuth users table holding player UUIDs, used for avatar URLs
+	BenjiAuthUUIDColumn string `toml:"benjiauth_uuid_column"`
+
+	// LuckPerms group every player belongs to, defaults to "default". It's never listed as staff
+	DefaultGroupName string `toml:"default_group_name"`
+
+	// LuckPerms server context of this network, e.g. "survival". When set, group assignments scoped to
+	// other servers are ignored, only ones for this server or "global" count. Primary groups carry no
+	// context and world and other contexts are not looked at, so those still count everywhere
+	LuckPermsServerContext string `toml:"luckperms_server_context"`
+
+	Pool     databasePoolConfig `toml:"pool"`
+	ReadPool databasePoolConfig `toml:"read_pool"`
+
+	// Keep each staff member only in their highest weight group. Off by default
+	SingleGroupPerMember bool `toml:"single_group_per_member"`
+
+	// Color used for groups without a color in their prefix, e.g. "#AAAAAA"
+	DefaultRankColor string `toml:"default_rank_color"`
+
+	// How color is picked from prefixes with multiple colors: "last" color in effect at the end of the prefix,
+	// "first" color set or "dominant" color covering most of the text. Defaults to "last"
+	ColorStrategy string `toml:"color_strategy"`
+
+	// List staff members as {"name": ..., "uuid": ...} objects instead of plain names
+	IncludeUUIDs bool `toml:"include_uuids"`
+
+	// Table (as "database.table") with player last seen times, which are added to staff members when set.
+	// Column must hold an unix timestamp. Values are only as fresh as the game server keeps them, which
+	// is usually on join/quit or on a periodic heartbeat
+	LastSeenTable      string `toml:"last_seen_table"`
+	LastSeenColumn     string `toml:"last_seen_column"`
+	LastSeenUUIDColumn string `toml:"last_seen_uuid_column"`
+
+	// Table (as "database.table") with username history, used for known_names of players. UUID column
+	// must hold dashed UUIDs like LuckPerms does
+	BenjiAuthHistoryTable      string `toml:"benjiauth_history_table"`
+	BenjiAuthHistoryUUIDColumn string `toml:"benjiauth_history_uuid_column"`
+	BenjiAuthHistoryNameColumn string `toml:"benjiauth_history_name_column"`
+
+	// Order of staff members within a group, either "name" or "last_seen" (requires last seen table)
+	MemberSort string `toml:"member_sort"`
+
+	// How long to keep retrying database connection at startup before starting without it, defaults to 1m
+	StartupWait duration `toml:"startup_wait"`
+	// How often database reachability is checked, defaults to 5s. Requests get 503 while it's unreachable
+	HealthCheckInterval duration `toml:"health_check_interval"`
+
+	// Connection options merged into database urls, left as in the url when unset. parseTime is
+	// on when neither sets it. db_loc is an IANA timezone name, e.g. "UTC"
+	DBParseTime *bool    `toml:"db_parse_time"`
+	DBCharset   string   `toml:"db_charset"`
+	DBLoc       string   `toml:"db_loc"`
+	DBTimeout   duration `toml:"db_timeout"`
+
+	// Table (as "database.table") with a row per vote, enables as_of snapshots of votes. Timestamp
+	// column is in seconds or milliseconds like last_vote_timestamp. Unset when only running totals are kept
+	ConfettiEventsTable           string `toml:"confetti_events_table"`
+	ConfettiEventsVoterColumn     string `toml:"confetti_events_voter_column"`
+	ConfettiEventsTimestampColumn string `toml:"confetti_events_timestamp_column"`
+
+	// List duplicate voter_name rows of votes table separately instead of summing their votes. Off by default
+	RawVoterRows bool `toml:"raw_voter_rows"`
+
+	// Columns of votes table holding current and best voting streak in days, added to voters and players
+	// when set. Unset when votes plugin does not track streaks
+	ConfettiCurrentStreakColumn string `toml:"confetti_current_streak_column"`
+	ConfettiBestStreakColumn    string `toml:"confetti_best_streak_column"`
+
+	// Column of votes table naming the vote site, e.g. "service". Unset when votes are not tracked per site
+	ConfettiSiteColumn string `toml:"confetti_site_column"`
+
+	// Fail staff requests when original usernames cannot be looked up, instead of falling back to LuckPerms usernames
+	StrictUsernames bool `toml:"strict_usernames"`
+}
+
+type databasePoolConfig struct {
+	MaxOpenConns    int      `toml:"max_open_conns"`
+	MaxIdleConns    int      `toml:"max_idle_conns"`
+	ConnMaxLifetime duration `toml:"conn_max_lifetime"`
+}
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return
+}
+
+func (c *throneDatabaseConfig) DSN() (string, error) {
+	return c.buildDSN(c.DatabaseURL)
+}
+
+// Falls back to primary database when read replica is not configured
+func (c *throneDatabaseConfig) ReadDSN() (string, error) {
+	if c.ReadDatabaseURL == "" {
+		return c.DSN()
+	}
+	return c.buildDSN(c.ReadDatabaseURL)
+}
+
+// Builds the final DSN by expanding ${VAR} placeholders in database url from the environment,
+// injecting the password from database_password_file, if set, and merging db_* connection options
+func (c *throneDatabaseConfig) buildDSN(databaseURL string) (string, error) {
+	var expandErr error
+	dsn := envPlaceholderRegexp.ReplaceAllStringFunc(databaseURL, func(placeholder string) string {
+		name := envPlaceholderRegexp.FindStringSubmatch(placeholder)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && expandErr == nil {
+			expandErr = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	parsed, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", fmt.Errorf("invalid database url: %w", err)
+	}
+
+	if c.DatabasePasswordFile != "" {
+		password, err := ioutil.ReadFile(c.DatabasePasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read database password file: %w", err)
+		}
+		parsed.Passwd = strings.TrimRight(string(password), "\r\n")
+	}
+
+	// Explicit connection options win over ones in database url
+	if c.DBParseTime != nil {
+		parsed.ParseTime = *c.DBParseTime
+	} else if !dsnHasParam(dsn, "parseTime") {
+		parsed.ParseTime = true
+	}
+	if c.DBCharset != "" {
+		if parsed.Params == nil {
+			parsed.Params = map[string]string{}
+		}
+		parsed.Params["charset"] = c.DBCharset
+	}
+	if c.DBLoc != "" {
+		if parsed.Loc, err = time.LoadLocation(c.DBLoc); err != nil {
+			return "", fmt.Errorf("invalid db_loc: %w", err)
+		}
+	}
+	if c.DBTimeout.Duration > 0 {
+		parsed.Timeout = c.DBTimeout.Duration
+	}
+
+	merged := parsed.FormatDSN()
+	if _, err := mysql.ParseDSN(merged); err != nil {
+		return "", fmt.Errorf("invalid database connection options: %w", err)
+	}
+	return merged, nil
+}
+
+// Whether parameters of dsn include name. Parameters follow the last slash, as mysql.ParseDSN expects
+func dsnHasParam(dsn string, name string) bool {
+	params := dsn[strings.LastIndex(dsn, "/")+1:]
+	i := strings.Index(params, "?")
+	if i < 0 {
+		return false
+	}
+
+	for _, param := range strings.Split(params[i+1:], "&") {
+		if strings.SplitN(param, "=", 2)[0] == name {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestBuildDSNParseTime(t *testing.T) {
+	on, off := true, false
+
+	cases := []struct {
+		name        string
+		databaseURL string
+		parseTime   *bool
+		expected    bool
+	}{
+		{"on by default", "user:pass@tcp(localhost:3306)/db", nil, true},
+		{"url on", "user:pass@tcp(localhost:3306)/db?parseTime=true", nil, true},
+		{"url off is kept", "user:pass@tcp(localhost:3306)/db?charset=utf8mb4&parseTime=false", nil, false},
+		{"option overrides url", "user:pass@tcp(localhost:3306)/db?parseTime=true", &off, false},
+		{"option on", "user:pass@tcp(localhost:3306)/db?parseTime=false", &on, true},
+		{"question mark in password", "user:p?parseTime=x@tcp(localhost:3306)/db", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dbConfig := throneDatabaseConfig{DatabaseURL: c.databaseURL, DBParseTime: c.parseTime}
+			dsn, err := dbConfig.DSN()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.ParseTime != c.expected {
+				t.Errorf("got parseTime %t, expected %t", parsed.ParseTime, c.expected)
+			}
+		})
+	}
+}
+
+func TestDBParseTimeUnsetInConfig(t *testing.T) {
+	var dbConfig throneDatabaseConfig
+	if _, err := toml.Decode(`database_url = "user@tcp(localhost)/db"`, &dbConfig); err != nil {
+		t.Fatal(err)
+	}
+	if dbConfig.DBParseTime != nil {
+		t.Errorf("got db_parse_time %t, expected it unset", *dbConfig.DBParseTime)
+	}
+
+	if _, err := toml.Decode(`db_parse_time = false`, &dbConfig); err != nil {
+		t.Fatal(err)
+	}
+	if dbConfig.DBParseTime == nil || *dbConfig.DBParseTime {
+		t.Error("expected db_parse_time to be set to false")
+	}
+}
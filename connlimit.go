@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// How often hitting max_connections is logged at most
+const connectionLimitLogInterval = 10 * time.Second
+
+// Listener holding off accepting new connections while max_connections are open, leaving them
+// waiting in the listen backlog. Same as netutil.LimitListener, but logs when the limit is hit.
+// Idle keep-alive connections count towards the limit too
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Only touched by Accept, which net/http calls from a single goroutine
+	lastLogged time.Time
+}
+
+func newLimitListener(listener net.Listener, maxConnections int) *limitListener {
+	return &limitListener{
+		Listener: listener,
+		slots:    make(chan struct{}, maxConnections),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if time.Since(l.lastLogged) >= connectionLimitLogInterval {
+			zap.L().Warn("connection limit reached, holding off new connections", zap.Int("maxConnections", cap(l.slots)))
+			l.lastLogged = time.Now()
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// Frees its slot of limitListener once closed
+type limitedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Serializes response envelopes. New formats can be added to responseEncoders
+type responseEncoder interface {
+	ContentType() string
+	Encode(v interface{}) ([]byte, error)
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) ContentType() string {
+	return "application/json"
+}
+
+func (jsonEncoder) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if config.RestAPI.DebugPretty {
+		encoder.SetIndent("", "  ")
+	}
+	err := encoder.Encode(v)
+	return buf.Bytes(), err
+}
+
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackEncoder) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	// Keep field names same as in JSON
+	encoder.SetCustomStructTag("json")
+	err := encoder.Encode(v)
+	return buf.Bytes(), err
+}
+
+// Accepted media types mapped to their encoders. JSON is used when none match
+var responseEncoders = map[string]responseEncoder{
+	"application/msgpack":   msgpackEncoder{},
+	"application/x-msgpack": msgpackEncoder{},
+}
+
+// Carries negotiated encoder and the request being answered to writeResponse
+type encoderResponseWriter struct {
+	http.ResponseWriter
+	encoder responseEncoder
+	raw     bool // Without status envelope, asked for with envelope=false
+	request *http.Request
+}
+
+// Picks response encoder from Accept header, and whether to leave out the envelope from "envelope" query parameter
+func encoderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var encoder responseEncoder = jsonEncoder{}
+		for _, mediaType := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType = strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0])
+			if found, ok := responseEncoders[mediaType]; ok {
+				encoder = found
+				break
+			}
+		}
+
+		w.Header().Add("Vary", "Accept")
+		raw := r.URL.Query().Get("envelope") == "false"
+		next.ServeHTTP(&encoderResponseWriter{w, encoder, raw, r}, r)
+	})
+}
+
+// Returns encoder negotiated by encoderMiddleware, or JSON encoder
+func encoderFor(w http.ResponseWriter) responseEncoder {
+	if ew, ok := w.(*encoderResponseWriter); ok {
+		return ew.encoder
+	}
+	return jsonEncoder{}
+}
+
+// Returns request the response is written for, or false when it's unknown
+func requestFor(w http.ResponseWriter) (*http.Request, bool) {
+	if ew, ok := w.(*encoderResponseWriter); ok {
+		return ew.request, true
+	}
+	return nil, false
+}
+
+// Whether response is written without status envelope
+func isRawResponse(w http.ResponseWriter) bool {
+	if ew, ok := w.(*encoderResponseWriter); ok {
+		return ew.raw
+	}
+	return false
+}
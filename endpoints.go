@@ -3,15 +3,31 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"net/http"
+	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+)
+
+// Sent through result channels when requested entity does not exist
+var errNotFound = errors.New("not found")
+
+// Values of empty_data, see restAPIConfig.EmptyData
+const (
+	emptyDataAsIs  = ""
+	emptyDataNull  = "null"
+	emptyDataEmpty = "empty"
+	emptyDataOmit  = "omit"
 )
 
 func writeResponse(w http.ResponseWriter, status int, body interface{}) {
@@ -22,319 +38,1005 @@ func writeResponse(w http.ResponseWriter, status int, body interface{}) {
 		stringStatus = errorStatus
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", config.RestAPI.CORSOrigins)
-	w.Header().Set("Access-Control-Allow-Methods", "GET")
+	if status == http.StatusOK && config.RestAPI.EmptyAs204 && isEmptyCollection(body) {
+		setCommonHeaders(w, encoderFor(w).ContentType())
+		// No body to describe
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var envelope interface{} = StatusResponse{stringStatus, body}
+	if isEmptyCollection(body) {
+		switch config.RestAPI.EmptyData {
+		case emptyDataNull:
+			envelope = StatusResponse{stringStatus, nil}
+		case emptyDataEmpty:
+			envelope = StatusResponse{stringStatus, emptyCollection(body)}
+		case emptyDataOmit:
+			envelope = StatusOnlyResponse{stringStatus}
+		}
+	}
+
+	raw := isRawResponse(w)
+	if raw {
+		envelope = withoutEnvelope(envelope)
+	}
+
+	encoder := encoderFor(w)
+	encoded, err := encoder.Encode(envelope)
+	if err != nil {
+		responseLogger(w).Error("failed to encode response", zap.Error(err))
+		encoder = jsonEncoder{}
+		envelope = StatusResponse{errorStatus, "failed to encode response"}
+		if raw {
+			envelope = withoutEnvelope(envelope)
+		}
+		encoded, _ = encoder.Encode(envelope)
+		status = http.StatusInternalServerError
+	}
+	writeBody(w, status, encoder.ContentType(), encoded)
+}
+
+// Unwraps data of a status envelope, leaving status to be told by HTTP status alone. Error
+// messages become {"error": message} objects, so that they can't be mistaken for data
+func withoutEnvelope(envelope interface{}) interface{} {
+	switch envelope := envelope.(type) {
+	case StatusResponse:
+		if envelope.Status == errorStatus {
+			return RawErrorResponse{envelope.Data}
+		}
+		return envelope.Data
+	default:
+		// Omitted data
+		return nil
+	}
+}
+
+// Whether body is a nil or empty map or slice
+func isEmptyCollection(body interface{}) bool {
+	v := reflect.ValueOf(body)
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice:
+		return v.Len() == 0
+	default:
+		return false
+	}
+}
+
+// Returns non-nil empty value of the same map or slice type, which serializes as {} or []
+func emptyCollection(body interface{}) interface{} {
+	v := reflect.ValueOf(body)
+	if v.Kind() == reflect.Map {
+		return reflect.MakeMap(v.Type()).Interface()
+	}
+	return reflect.MakeSlice(v.Type(), 0, 0).Interface()
+}
+
+// Logs internal error and responds with 500 and a message safe to show to clients. The error
+// itself never ends up in the response
+func writeError(ctx context.Context, w http.ResponseWriter, err error, logMessage string, clientMessage string) {
+	// Queries fail with context error when request context ends while they run
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		writeContextError(ctx, w)
+		return
+	}
+
+	logger(ctx).Error(logMessage, zap.Error(err))
+	writeResponse(w, http.StatusInternalServerError, clientMessage)
+}
+
+// HTTP status of responses to clients which went away, following nginx. They never see it, but it
+// ends up in access logs
+const statusClientClosedRequest = 499
+
+// Responds to a request whose context ended before its response was ready. Running out of time is
+// an error, client going away is not
+func writeContextError(ctx context.Context, w http.ResponseWriter) {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		logger(ctx).Info("client went away before response was ready")
+		writeResponse(w, statusClientClosedRequest, "client closed request")
+		return
+	}
+
+	logger(ctx).Error("timed out while getting or processing database entries", zap.Error(ctx.Err()))
+	writeResponse(w, http.StatusGatewayTimeout, "timed out")
+}
+
+// Writes fully serialized body along with Content-Length and ETag headers, or 304 when client already
+// has the same body. Body is discarded by net/http for HEAD requests, leaving just the headers
+func writeBody(w http.ResponseWriter, status int, contentType string, body []byte) {
+	setCommonHeaders(w, contentType)
+	if status != http.StatusOK {
+		// Errors are never worth caching
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	etag := bodyETag(body)
+	w.Header().Set("ETag", etag)
+
+	if r, ok := requestFor(w); ok && status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		// Not modified responses have no body to describe
+		w.Header().Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(StatusResponse{stringStatus, body})
+	w.Write(body)
+}
+
+func bodyETag(body []byte) string {
+	hash := fnv.New64a()
+	hash.Write(body)
+	return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
+
+// Whether If-None-Match header lists etag. Comparison is weak, as RFC 7232 asks for If-None-Match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Answers HEAD request whose response is not cached. Rendering the body only to measure it would take
+// the full query, so database reachability is checked instead and the response goes without
+// Content-Length and ETag
+func (e *Endpoints) writeHeadOnly(w http.ResponseWriter, r *http.Request, contentType string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if err := e.readDB.PingContext(ctx); err != nil {
+		writeError(ctx, w, err, "failed to reach database", "database access error")
+		return
+	}
+	setCommonHeaders(w, contentType)
+	w.WriteHeader(http.StatusOK)
+}
+
+func setCommonHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	setCORSHeaders(w)
+}
+
+// Sets Cache-Control header for successful responses of given handler, others get "no-store"
+func withCacheControl(cacheControl string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		handler(w, r)
+	}
+}
+
+func setCORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", config.RestAPI.CORSOrigins)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+	if config.RestAPI.CORSMaxAge.Duration > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.RestAPI.CORSMaxAge.Duration.Seconds())))
+	}
+	if config.RestAPI.CORSAllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Rejects query parameters not in allowed list when strict_query_params is enabled.
+// Returns false if the request was rejected and response is already written
+func checkQueryParams(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	if !config.RestAPI.StrictQueryParams {
+		return true
+	}
+
+	for key := range r.URL.Query() {
+		// Handled by encoderMiddleware for every endpoint
+		known := key == "envelope"
+		for _, allowedKey := range allowed {
+			if key == allowedKey {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("unknown query parameter: %s", key))
+			return false
+		}
+	}
+
+	return true
+}
+
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusNotFound, "not found")
+}
+
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	// No route accepts OPTIONS, so CORS preflight requests end up here
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		setCORSHeaders(w)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeResponse(w, http.StatusMethodNotAllowed, "method not allowed")
 }
 
 type Endpoints struct {
 	db *sql.DB
+
+	// Used by read-only endpoints, same as db when no read replica is configured
+	readDB *sql.DB
+
+	staffCache  *responseCache
+	votersCache *responseCache
+	statsCache  *responseCache
+
+	// Limits concurrently running expensive queries, nil when unlimited
+	heavyQueries *semaphore.Weighted
+}
+
+// Waits for a free expensive query slot until context deadline. Returns false if request was
+// rejected and response is already written, otherwise caller must call releaseHeavyQuery afterwards
+func (e *Endpoints) acquireHeavyQuery(ctx context.Context, w http.ResponseWriter) bool {
+	if e.heavyQueries == nil {
+		return true
+	}
+
+	if err := e.heavyQueries.Acquire(ctx, 1); err != nil {
+		logger(ctx).Warn("too many concurrent expensive queries, rejecting request")
+		writeResponse(w, http.StatusServiceUnavailable, "server is busy")
+		return false
+	}
+	return true
+}
+
+func (e *Endpoints) releaseHeavyQuery() {
+	if e.heavyQueries != nil {
+		e.heavyQueries.Release(1)
+	}
 }
 
 func (e *Endpoints) HandleVoters(w http.ResponseWriter, r *http.Request) {
-	votersLimit := -1
-	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
-		if num, err := strconv.Atoi(limitStr); err == nil && num > 0 {
-			votersLimit = num
+	if !checkQueryParams(w, r, "limit", "offset", "plain", "format", "sort", "fields", "min_votes", "since", "period", "as_of", "relative", "search") {
+		return
+	}
+
+	query, err := parseVotersQuery(r)
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	fields, ok := parseFields(w, r, VoterInfo{})
+	if !ok {
+		return
+	}
+
+	if cached, ok := e.votersCache.Get(query.cacheKey()); ok {
+		entry := cached.(cachedVoters)
+		if checkVotesModified(w, r, entry.lastModified) {
+			writeVoters(w, r, query, fields, entry.voters)
+		}
+		return
+	}
+
+	// Full query is worth running for HEAD only when its result gets cached. Latest vote in the whole
+	// table is as recent as the one on any page, so it still makes up Last-Modified
+	if r.Method == http.MethodHead && !e.votersCache.Enabled() {
+		e.writeVotersHead(w, r, query)
+		return
+	}
+
+	// Streaming writes JSON rows as they are read, so masked and non-JSON responses are buffered
+	// instead. Streamed responses are not cached. HEAD requests are buffered too, as they are
+	// after Content-Length and ETag, which streamed responses can't have
+	_, isJSON := encoderFor(w).(jsonEncoder)
+	// Empty plain list can't be told apart before streaming it, so empty_data and empty_as_204 require buffering
+	canStream := r.Method != http.MethodHead &&
+		(!query.plain || (config.RestAPI.EmptyData == emptyDataAsIs && !config.RestAPI.EmptyAs204))
+	if query.limit == -1 && query.format == jsonFormat && isJSON && fields == nil && canStream {
+		e.streamVoters(w, r, query)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.VotersTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	go e.fetchVoters(ctx, query, resultCh)
+
+	select {
+	case result := <-resultCh:
+		if err, ok := result.(error); ok {
+			writeError(ctx, w, err, "failed to fetch votes", "database access error")
 		} else {
-			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", limitStr))
-			return
+			entry := cachedVoters{result, votersLastModified(result)}
+			e.votersCache.Set(query.cacheKey(), entry)
+			if checkVotesModified(w, r, entry.lastModified) {
+				writeVoters(w, r, query, fields, result)
+			}
 		}
+	case <-ctx.Done():
+		writeContextError(ctx, w)
+	}
+}
+
+// Answers HEAD request for votes with Last-Modified from the latest vote, without running the query
+// behind the response body. Snapshots of past votes get no Last-Modified
+func (e *Endpoints) writeVotersHead(w http.ResponseWriter, r *http.Request, query *votersQuery) {
+	contentType := encoderFor(w).ContentType()
+	if query.format == csvFormat {
+		contentType = csvContentType
+	}
+	if query.asOf != 0 {
+		e.writeHeadOnly(w, r, contentType, config.RestAPI.VotersTimeout.Duration)
+		return
 	}
 
-	// 3 seconds to query the voters and process the data. Should be fine?
-	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.VotersTimeout.Duration)
+	defer cancel()
+
+	var latest sql.NullInt64
+	err := e.queryRow(ctx, "votes_last_modified",
+		fmt.Sprintf("select max(last_vote_timestamp) from %s.%s;",
+			config.Database.ConfettiDatabaseName,
+			config.Database.ConfettiVotesTableName)).
+		Scan(&latest)
+	if err != nil {
+		writeError(ctx, w, err, "failed to fetch latest vote", "database access error")
+		return
+	}
+
+	var lastModified time.Time
+	if latest.Valid {
+		lastModified = voteTime(uint64(latest.Int64))
+	}
+	if checkVotesModified(w, r, lastModified) {
+		setCommonHeaders(w, contentType)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Writes VoterList or VotersPage in requested format
+func writeVoters(w http.ResponseWriter, r *http.Request, query *votersQuery, fields *fieldMask, voters interface{}) {
+	if wantsRelative(r) {
+		voters = withRelativeVoters(voters, time.Now())
+	}
+	if query.format == csvFormat {
+		// CSV exports can be large, so let interrupted downloads resume
+		writeRangedCSVResponse(w, r, voters.(csvRecords))
+	} else {
+		writeResponse(w, http.StatusOK, fields.apply(voters))
+	}
+}
+
+func (e *Endpoints) HandleVotesSummary(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.VotersTimeout.Duration)
 	defer cancel()
 	resultCh := make(chan interface{}, 1)
 
 	go func() {
-		var limitStr string
-		if votersLimit != -1 {
-			limitStr = fmt.Sprintf("limit %d", votersLimit)
-		} else {
-			limitStr = ""
-		}
-		rows, err := e.db.QueryContext(ctx,
-			// Pls no bully but prepared statements are not needed here - not handling user input, technically
-			fmt.Sprintf("select voter_name, votes, last_vote_timestamp from %s.%s order by votes desc %s;",
-				config.Database.ConfettiDatabaseName,
-				config.Database.ConfettiVotesTableName,
-				limitStr))
+		defer recoverWorker(ctx, failTo(resultCh))
+
+		summary, err := e.fetchVotesSummary(ctx)
 		if err != nil {
 			resultCh <- err
 			return
 		}
-		defer rows.Close()
 
-		voters := []VoterInfo{}
-		for rows.Next() {
-			voter := VoterInfo{}
-			if err := rows.Scan(&(voter.Username), &(voter.Votes), &(voter.Timestamp)); err != nil {
-				zap.L().Warn("failed to scan row", zap.Error(err))
-				continue
-			}
-			voters = append(voters, voter)
-		}
-
-		resultCh <- voters
+		resultCh <- summary
 	}()
 
 	select {
 	case result := <-resultCh:
 		if err, ok := result.(error); ok {
-			zap.L().Error("failed to fetch votes", zap.Error(err))
-			writeResponse(w, http.StatusInternalServerError, "database access error")
+			writeError(ctx, w, err, "failed to fetch votes summary", "database access error")
 		} else {
 			writeResponse(w, http.StatusOK, result)
 		}
 	case <-ctx.Done():
-		zap.L().Error("timed out while getting or processing database entries")
-		writeResponse(w, http.StatusInternalServerError, "timed out")
+		writeContextError(ctx, w)
 	}
 }
 
+func (e *Endpoints) fetchVotesSummary(ctx context.Context) (VotesSummary, error) {
+	summary := VotesSummary{}
+	err := e.queryRow(ctx, "votes_summary",
+		fmt.Sprintf("select coalesce(sum(votes), 0), count(*), coalesce(max(last_vote_timestamp), 0) from %s;",
+			votesTableSQL("voters"))).
+		Scan(&(summary.TotalVotes), &(summary.TotalVoters), &(summary.LastVote))
+	return summary, err
+}
+
 func (e *Endpoints) HandleStaff(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r, "min_weight", "fields", "order", "relative") {
+		return
+	}
 
-	// 5 seconds to query the groups and players, and finally process the data. Should be enough
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-	resultCh := make(chan interface{}, 1)
+	// Groups are keyed by name unless order is asked for, then they're listed in staff_group_names order
+	orderByConfig := false
+	if orderStr := r.URL.Query().Get("order"); orderStr == "config" {
+		orderByConfig = true
+	} else if orderStr != "" {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid order: %s", orderStr))
+		return
+	}
 
-	go func() {
-		collectedRanks := map[string]*GroupInfo{}
-		primaryGroupsScanned := make(chan map[string]*GroupInfo, 1)
-		userPermissionsScanned := make(chan map[string]*GroupInfo, 1)
-
-		// Collect groups and their members from players table
-		go func() {
-			rows1, err := e.db.QueryContext(ctx,
-				// TODO: let database do the work and filter out unwanted groups
-				fmt.Sprintf("select (select original_username from %[1]s.%[2]s where username = %[3]s.%[4]splayers.username) as username, primary_group from %[3]s.%[4]splayers;",
-					config.Database.BenjiAuthDatabaseName,
-					config.Database.BenjiAuthUsersTableName,
-					config.Database.LuckPermsDatabaseName,
-					config.Database.LuckPermsTablePrefix))
-			if err != nil {
-				resultCh <- err
-				return
-			}
-			defer rows1.Close()
+	fields, ok := parseFields(w, r, GroupInfo{})
+	if !ok {
+		return
+	}
 
-			collected := map[string]*GroupInfo{}
+	minWeight, hasMinWeight := 0, false
+	if minWeightStr := r.URL.Query().Get("min_weight"); minWeightStr != "" {
+		if num, err := strconv.Atoi(minWeightStr); err == nil {
+			minWeight, hasMinWeight = num, true
+		} else {
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid min_weight: %s", minWeightStr))
+			return
+		}
+	}
 
-			var username *string
-			var primaryGroup *string
-			for rows1.Next() {
-				if err := rows1.Scan(&username, &primaryGroup); err != nil {
-					zap.L().Warn("failed to scan row", zap.Error(err))
-					continue
+	if ranks, ok := e.getStaff(w, r); ok {
+		// Weights are known only after all queries are done, so filter here. Cached map must not be modified
+		relative, now := wantsRelative(r), time.Now()
+		result := map[string]*GroupInfo{}
+		for rankName, rank := range ranks {
+			if !hasMinWeight || rank.Weight >= minWeight {
+				result[rankName] = capMembers(rank)
+				if relative {
+					result[rankName] = withRelativeMembers(result[rankName], now)
 				}
+			}
+		}
 
-				// Skip nil usernames and primaryGroups
-				if username == nil || primaryGroup == nil {
-					continue
+		if orderByConfig {
+			ordered := []*GroupInfo{}
+			for _, rankName := range config.Database.StaffGroupNames {
+				rankName = normalizeGroupName(rankName)
+				if rank, ok := result[rankName]; ok {
+					named := *rank
+					named.Name = rankDisplayName(rankName)
+					ordered = append(ordered, &named)
+					// Listed once even if configured twice
+					delete(result, rankName)
 				}
+			}
+			writeResponse(w, http.StatusOK, fields.apply(ordered))
+			return
+		}
 
-				// Filter players out only from relevant groups
-				if _, ok := checkedRankNames[*primaryGroup]; !ok {
-					continue
-				}
+		byName := map[string]*GroupInfo{}
+		for rankName, rank := range result {
+			byName[rankDisplayName(rankName)] = rank
+		}
+		writeResponse(w, http.StatusOK, fields.apply(byName))
+	}
+}
 
-				if _, ok := collected[*primaryGroup]; !ok {
-					collected[*primaryGroup] = &GroupInfo{}
-				}
+func (e *Endpoints) HandleStaffGroup(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r, "fields", "member_limit", "member_offset", "relative") {
+		return
+	}
 
-				collected[*primaryGroup].Members = append(collected[*primaryGroup].Members, *username)
-			}
+	fields, ok := parseFields(w, r, GroupInfo{})
+	if !ok {
+		return
+	}
 
-			primaryGroupsScanned <- collected
-		}()
-
-		// Collect groups from user permissions
-		go func() {
-			rows2, err := e.db.QueryContext(ctx,
-				// TODO: let database do the work and filter out unwanted groups
-				fmt.Sprintf("select permission, (select (select original_username from %[3]s.%[4]s where username = %[1]s.%[2]splayers.username) as "+
-					"username from %[1]s.%[2]splayers where "+
-					"%[1]s.%[2]splayers.uuid = %[1]s.%[2]suser_permissions.uuid) as name from "+
-					"%[1]s.%[2]suser_permissions where permission like 'group.%%';",
-					config.Database.LuckPermsDatabaseName,
-					config.Database.LuckPermsTablePrefix,
-					config.Database.BenjiAuthDatabaseName,
-					config.Database.BenjiAuthUsersTableName))
-			if err != nil {
-				resultCh <- err
-				return
+	memberLimit, memberOffset := 0, 0
+	if limitStr := r.URL.Query().Get("member_limit"); limitStr != "" {
+		if num, err := strconv.Atoi(limitStr); err == nil && num > 0 {
+			memberLimit = num
+		} else {
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid member_limit: %s", limitStr))
+			return
+		}
+	}
+	if offsetStr := r.URL.Query().Get("member_offset"); offsetStr != "" {
+		if num, err := strconv.Atoi(offsetStr); err == nil && num >= 0 {
+			memberOffset = num
+		} else {
+			writeResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid member_offset: %s", offsetStr))
+			return
+		}
+	}
+
+	requestedName := mux.Vars(r)["group"]
+	groupName := resolveRankName(requestedName)
+	if _, ok := checkedRankNames[groupName]; !ok {
+		writeResponse(w, http.StatusNotFound, fmt.Sprintf("unknown staff group: %s", requestedName))
+		return
+	}
+
+	if ranks, ok := e.getStaff(w, r); ok {
+		if rank, ok := ranks[groupName]; ok {
+			if memberLimit > 0 || memberOffset > 0 {
+				rank = pageMembers(rank, memberLimit, memberOffset)
+			} else {
+				rank = capMembers(rank)
+			}
+			if wantsRelative(r) {
+				rank = withRelativeMembers(rank, time.Now())
 			}
-			defer rows2.Close()
+			writeResponse(w, http.StatusOK, fields.apply(rank))
+		} else {
+			writeResponse(w, http.StatusNotFound, fmt.Sprintf("staff group has no members: %s", requestedName))
+		}
+	}
+}
 
-			collected := map[string]*GroupInfo{}
+// Limits group members to max_members_per_group. Returns a truncated copy, as given group may be cached
+func capMembers(rank *GroupInfo) *GroupInfo {
+	maxMembers := config.RestAPI.MaxMembersPerGroup
+	if maxMembers <= 0 || len(rank.Members) <= maxMembers {
+		return rank
+	}
 
-			var permissionNode *string
-			var username *string
-			for rows2.Next() {
-				if err := rows2.Scan(&permissionNode, &username); err != nil {
-					zap.L().Warn("failed to scan row", zap.Error(err))
-					continue
-				}
+	capped := *rank
+	capped.Members = rank.Members[:maxMembers:maxMembers]
+	capped.Truncated = true
+	capped.TotalMembers = len(rank.Members)
+	return &capped
+}
 
-				// Skip nil usernames and permission nodes
-				if username == nil || permissionNode == nil {
-					continue
-				}
+// Returns a copy of group with a page of its members and total member count. Limit of 0 means
+// up to max_members_per_group
+func pageMembers(rank *GroupInfo, limit int, offset int) *GroupInfo {
+	if maxMembers := config.RestAPI.MaxMembersPerGroup; maxMembers > 0 && (limit == 0 || limit > maxMembers) {
+		limit = maxMembers
+	}
 
-				split := strings.Split(*permissionNode, ".")
-				if len(split) != 2 {
-					zap.L().Warn("unable to parse group permission node", zap.String("node", *permissionNode))
-					continue
-				}
-				rankName := split[1]
+	paged := *rank
+	paged.TotalMembers = len(rank.Members)
+	if offset > len(rank.Members) {
+		offset = len(rank.Members)
+	}
+	end := len(rank.Members)
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+	}
+	paged.Members = rank.Members[offset:end:end]
+	return &paged
+}
 
-				// Filter players out only from relevant groups
-				if _, ok := checkedRankNames[rankName]; !ok {
-					continue
-				}
+// Lists staff groups of a single member, highest weight first
+func (e *Endpoints) HandleStaffMember(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
 
-				if _, ok := collected[rankName]; !ok {
-					collected[rankName] = &GroupInfo{}
+	name := mux.Vars(r)["name"]
+	if ranks, ok := e.getStaff(w, r); ok {
+		groups := []RankInfo{}
+		for rankName, rank := range ranks {
+			for _, member := range rank.Members {
+				// Usernames from BenjiAuth keep original casing
+				if strings.EqualFold(member.Name, name) {
+					groups = append(groups, RankInfo{
+						Group:  rankDisplayName(rankName),
+						Title:  rank.Title,
+						Color:  rank.Color,
+						Weight: rank.Weight,
+					})
+					break
 				}
+			}
+		}
 
-				collected[rankName].Members = append(collected[rankName].Members, *username)
+		if len(groups) == 0 {
+			writeResponse(w, http.StatusNotFound, fmt.Sprintf("not a staff member: %s", name))
+			return
+		}
+
+		sort.Slice(groups, func(i, j int) bool {
+			if groups[i].Weight != groups[j].Weight {
+				return groups[i].Weight > groups[j].Weight
 			}
+			return groups[i].Group < groups[j].Group
+		})
+		writeResponse(w, http.StatusOK, groups)
+	}
+}
+
+// Lists configured staff groups with their title, color and weight, but without members
+func (e *Endpoints) HandleStaffGroups(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	go func() {
+		defer recoverWorker(ctx, failTo(resultCh))
 
-			userPermissionsScanned <- collected
-		}()
+		ranks := map[string]*GroupInfo{}
+		for rankName := range checkedRankNames {
+			ranks[rankName] = &GroupInfo{}
+		}
 
-		// Wait for primary groups scan
-		if s := <-primaryGroupsScanned; s != nil {
-			for k, v := range s {
-				collectedRanks[k] = v
+		if len(ranks) > 0 {
+			if err := e.fetchGroupNodes(ctx, ranks); err != nil {
+				resultCh <- err
+				return
 			}
 		}
 
-		// Wait for user permissions scan
-		if s := <-userPermissionsScanned; s != nil {
-			for rankName, collectedRank := range s {
-				if rank, ok := collectedRanks[rankName]; ok {
-					existingMembers := map[string]bool{}
-					for _, name := range rank.Members {
-						existingMembers[name] = true
-					}
-
-					for _, name := range collectedRank.Members {
-						if _, ok := existingMembers[name]; !ok {
-							rank.Members = append(rank.Members, name)
-						}
-					}
-				} else {
-					collectedRanks[rankName] = collectedRank
-				}
+		groups := map[string]GroupMetadata{}
+		for rankName, rank := range ranks {
+			applyRankFallback(ctx, rankName, rank)
+			groups[rankDisplayName(rankName)] = GroupMetadata{
+				Title:  rank.Title,
+				Color:  rank.Color,
+				Weight: rank.Weight,
 			}
 		}
 
-		// Sort group members
-		for _, rank := range collectedRanks {
-			sort.Strings(rank.Members)
+		resultCh <- groups
+	}()
+
+	select {
+	case result := <-resultCh:
+		if err, ok := result.(error); ok {
+			writeError(ctx, w, err, "failed to fetch staff groups", "database access error")
+		} else {
+			writeResponse(w, http.StatusOK, result)
 		}
+	case <-ctx.Done():
+		writeContextError(ctx, w)
+	}
+}
 
-		// Query group title and color
-		var groupNamesQuery strings.Builder
-		if len(collectedRanks) > 0 {
-			for rankName := range collectedRanks {
-				fmt.Fprintf(&groupNamesQuery, "name = '%s' or ", rankName)
-			}
+// Returns staff groups from cache or database. Returns false if fetching failed and error response is already written
+func (e *Endpoints) getStaff(w http.ResponseWriter, r *http.Request) (map[string]*GroupInfo, bool) {
+	if cached, ok := e.staffCache.Get(staffCacheKey); ok {
+		return cached.(map[string]*GroupInfo), true
+	}
+
+	// Full query is worth running for HEAD only when its result gets cached
+	if r.Method == http.MethodHead && !e.staffCache.Enabled() {
+		e.writeHeadOnly(w, r, encoderFor(w).ContentType(), config.RestAPI.StaffTimeout.Duration)
+		return nil, false
+	}
+
+	// Deriving from request context means that whichever deadline comes first wins
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	if !e.acquireHeavyQuery(ctx, w) {
+		return nil, false
+	}
+
+	go func() {
+		defer e.releaseHeavyQuery()
+		e.fetchStaff(ctx, resultCh)
+	}()
+
+	select {
+	case result := <-resultCh:
+		if err, ok := result.(error); ok {
+			writeError(ctx, w, err, "failed to fetch staff info", "database access error")
+			return nil, false
+		}
+
+		ranks := result.(map[string]*GroupInfo)
+		if !isPartialStaff(ranks) {
+			e.staffCache.Set(staffCacheKey, ranks)
+		}
+		return ranks, true
+	case <-ctx.Done():
+		writeContextError(ctx, w)
+		return nil, false
+	}
+}
+
+func (e *Endpoints) HandleVersion(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
+
+	writeResponse(w, http.StatusOK, VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	})
+}
+
+func (e *Endpoints) HandleFlushCache(w http.ResponseWriter, r *http.Request) {
+	cleared := e.staffCache.Flush() + e.votersCache.Flush() + e.statsCache.Flush()
+	logger(r.Context()).Info("cache flushed", zap.Int("cleared", cleared))
+	writeResponse(w, http.StatusOK, CacheFlushResult{Cleared: cleared})
+}
+
+// Quick health snapshot for operators: runtime, database pool and cache stats
+func (e *Endpoints) HandleAdminStats(w http.ResponseWriter, r *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	stats := AdminStats{
+		UptimeSeconds: int64(time.Since(startTime) / time.Second),
+		Goroutines:    runtime.NumGoroutine(),
+		Memory: MemoryStats{
+			HeapAlloc:  memStats.HeapAlloc,
+			HeapInuse:  memStats.HeapInuse,
+			Sys:        memStats.Sys,
+			TotalAlloc: memStats.TotalAlloc,
+			NumGC:      memStats.NumGC,
+		},
+		Database:     dbPoolStats(e.db),
+		CacheEntries: map[string]int{},
+	}
+	if e.readDB != e.db {
+		readStats := dbPoolStats(e.readDB)
+		stats.ReadDatabase = &readStats
+	}
+	for _, cache := range []*responseCache{e.staffCache, e.votersCache, e.statsCache} {
+		stats.CacheEntries[cache.name] = cache.Len()
+	}
+
+	writeResponse(w, http.StatusOK, stats)
+}
+
+func dbPoolStats(db *sql.DB) DBPoolStats {
+	dbStats := db.Stats()
+	return DBPoolStats{
+		MaxOpenConnections: dbStats.MaxOpenConnections,
+		OpenConnections:    dbStats.OpenConnections,
+		InUse:              dbStats.InUse,
+		Idle:               dbStats.Idle,
+		WaitCount:          dbStats.WaitCount,
+		WaitDurationMillis: dbStats.WaitDuration.Milliseconds(),
+	}
+}
+
+func (e *Endpoints) HandlePlayer(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r, "breakdown", "relative") {
+		return
+	}
+
+	player := mux.Vars(r)["player"]
+	breakdown := r.URL.Query().Get("breakdown") == "true"
+	e.writePlayers(w, r, []string{player}, breakdown, func(players map[string]*PlayerInfo) {
+		if info, ok := players[player]; ok {
+			writeResponse(w, http.StatusOK, info)
 		} else {
-			// Write atleast one valid SQL value to avoid syntax error + ' or ' to make slicing work fine
-			groupNamesQuery.WriteString("1 or ")
+			writeResponse(w, http.StatusNotFound, "player not found")
 		}
+	})
+}
 
-		rows3, err := e.db.QueryContext(ctx,
-			fmt.Sprintf(
-				"select name, permission from %s.%sgroup_permissions where (%s) and "+
-					"(permission like 'prefix.%%' or permission like 'weight.%%');",
-				config.Database.LuckPermsDatabaseName,
-				config.Database.LuckPermsTablePrefix,
-				groupNamesQuery.String()[:groupNamesQuery.Len()-4]))
+func (e *Endpoints) HandlePlayers(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r, "names", "relative") {
+		return
+	}
+
+	var names []string
+	for _, name := range strings.Split(r.URL.Query().Get("names"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		writeResponse(w, http.StatusBadRequest, "no player names given")
+		return
+	} else if len(names) > config.RestAPI.MaxBatchPlayers {
+		writeResponse(w, http.StatusBadRequest, fmt.Sprintf("too many players, at most %d allowed", config.RestAPI.MaxBatchPlayers))
+		return
+	}
+
+	e.writePlayers(w, r, names, false, func(players map[string]*PlayerInfo) {
+		writeResponse(w, http.StatusOK, players)
+	})
+}
+
+// Fetches given players and passes them to onSuccess, or writes an error response.
+// With breakdown, votes per vote site are included too
+func (e *Endpoints) writePlayers(w http.ResponseWriter, r *http.Request, names []string, breakdown bool, onSuccess func(map[string]*PlayerInfo)) {
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	// Player lookups join LuckPerms, votes and username tables, just like staff queries
+	if !e.acquireHeavyQuery(ctx, w) {
+		return
+	}
+
+	go func() {
+		defer e.releaseHeavyQuery()
+		defer recoverWorker(ctx, failTo(resultCh))
+
+		players, err := e.fetchPlayers(ctx, names)
 		if err != nil {
 			resultCh <- err
 			return
 		}
-		defer rows3.Close()
 
-		var groupName string
-		var permissionNode string
-		for rows3.Next() {
-			if err := rows3.Scan(&groupName, &permissionNode); err != nil {
-				zap.L().Warn("failed to scan row", zap.Error(err))
-				continue
+		if breakdown {
+			if err := e.fillVoteBreakdown(ctx, players); err != nil {
+				resultCh <- err
+				return
+			}
+		}
+
+		if config.Database.BenjiAuthHistoryTable != "" {
+			if err := e.fillKnownNames(ctx, players); err != nil {
+				resultCh <- err
+				return
+			}
+		}
+
+		if wantsRelative(r) {
+			now := time.Now()
+			for _, player := range players {
+				player.setRelative(now)
 			}
+		}
 
-			split := strings.Split(permissionNode, ".")
+		resultCh <- players
+	}()
 
-			switch split[0] {
-			case "weight":
-				if num, err := strconv.Atoi(split[1]); err == nil {
-					if rank, ok := collectedRanks[groupName]; ok {
-						rank.Weight = num
-					} else {
-						zap.L().Error("got weight for unknown group", zap.String("node", permissionNode), zap.String("groupName", groupName))
-					}
+	select {
+	case result := <-resultCh:
+		if err, ok := result.(error); ok {
+			writeError(ctx, w, err, "failed to fetch players", "database access error")
+		} else {
+			onSuccess(result.(map[string]*PlayerInfo))
+		}
+	case <-ctx.Done():
+		writeContextError(ctx, w)
+	}
+}
 
-				}
-			case "prefix":
-				var minecraftPrefix string
-				switch len(split) {
-				case 2:
-					minecraftPrefix = split[1]
-				case 3:
-					minecraftPrefix = split[2]
-				default:
-					zap.L().Warn("could not get rank prefix", zap.String("rankName", groupName))
-					minecraftPrefix = ""
-				}
+// Returns player's place on the votes leaderboard. Uses standard competition ranking, so
+// players with equal votes share a position and the next position is skipped (1, 2, 2, 4)
+func (e *Endpoints) HandlePlayerVotePosition(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
 
-				if rank, ok := collectedRanks[groupName]; ok {
-					// Get rank color by getting last color code
-					// Not perfect but most likely works
-					colorMatches := chatColorRegexp.FindAllString(minecraftPrefix, -1)
-					if len(colorMatches) > 0 {
-						foundColor := strings.ToLower(colorMatches[len(colorMatches)-1][1:])
-						if hexColor, ok := chatColorsToHex[foundColor]; ok {
-							rank.Color = hexColor
-						}
-					}
-
-					// Get rank title by stripping minecraft color codes
-					rank.Title = chatColorRegexp.ReplaceAllString(minecraftPrefix, "")
-
-					// Post process (unescape etc.)
-					rank.Title = strings.ReplaceAll(rank.Title, `\`, "")
-				} else {
-					zap.L().Error("got prefix for unknown group", zap.String("node", permissionNode), zap.String("groupName", groupName))
-				}
+	player := mux.Vars(r)["player"]
 
-			}
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.VotersTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	go func() {
+		defer recoverWorker(ctx, failTo(resultCh))
+
+		position := VotePosition{}
+		err := e.queryRow(ctx, "vote_position",
+			// Ranked against the same table as the leaderboard, so that collapsed duplicates agree with it
+			fmt.Sprintf("select v.voter_name, v.votes, (select count(*) from %s where others.votes > v.votes) + 1 "+
+				"from %s where v.voter_name = ?;",
+				votesTableSQL("others"),
+				votesTableSQL("v")),
+			strings.ToLower(player)).
+			Scan(&(position.Name), &(position.Votes), &(position.Position))
+		if err == sql.ErrNoRows {
+			resultCh <- errNotFound
+			return
+		} else if err != nil {
+			resultCh <- err
+			return
 		}
 
-		resultCh <- collectedRanks
+		resultCh <- position
 	}()
 
 	select {
 	case result := <-resultCh:
-		if err, ok := result.(error); ok {
-			zap.L().Error("failed to fetch staff info", zap.Error(err))
-			writeResponse(w, http.StatusInternalServerError, "database access error")
+		if result == errNotFound {
+			writeResponse(w, http.StatusNotFound, "player has not voted")
+		} else if err, ok := result.(error); ok {
+			writeError(ctx, w, err, "failed to fetch vote position", "database access error")
 		} else {
 			writeResponse(w, http.StatusOK, result)
 		}
 	case <-ctx.Done():
-		zap.L().Error("timed out while getting or processing database entries")
-		writeResponse(w, http.StatusInternalServerError, "timed out")
+		writeContextError(ctx, w)
 	}
 }
 
-func (e *Endpoints) HandlePlayer(w http.ResponseWriter, r *http.Request) {
-	writeResponse(w, http.StatusNotImplemented, "not done yet")
+func (e *Endpoints) HandlePlayerRank(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
+
+	player := mux.Vars(r)["player"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	go func() {
+		defer recoverWorker(ctx, failTo(resultCh))
+
+		// LuckPerms stores usernames in lowercase
+		var primaryGroup string
+		err := e.queryRow(ctx, "player_rank_group",
+			fmt.Sprintf("select primary_group from %s.%splayers where username = ?;",
+				config.Database.LuckPermsDatabaseName,
+				config.Database.LuckPermsTablePrefix),
+			strings.ToLower(player)).
+			Scan(&primaryGroup)
+		if err == sql.ErrNoRows {
+			resultCh <- errNotFound
+			return
+		} else if err != nil {
+			resultCh <- err
+			return
+		}
+
+		// Left join to tell apart missing groups and groups without prefix/weight
+		rows, err := e.query(ctx, "player_rank_nodes",
+			fmt.Sprintf(
+				"select gp.permission from %[1]s.%[2]sgroups g left join %[1]s.%[2]sgroup_permissions gp on gp.name = g.name and "+
+					"(gp.permission like 'prefix.%%' or gp.permission like 'weight.%%' or gp.permission like 'meta.weight.%%' or "+
+					"gp.permission like 'displayname.%%') where g.name = ?;",
+				config.Database.LuckPermsDatabaseName,
+				config.Database.LuckPermsTablePrefix),
+			primaryGroup)
+		if err != nil {
+			resultCh <- err
+			return
+		}
+		defer rows.Close()
+
+		found := false
+		rank := &GroupInfo{}
+		var permissionNode *string
+		for rows.Next() {
+			if err := rows.Scan(&permissionNode); err != nil {
+				logger(ctx).Warn("failed to scan row", zap.Error(err))
+				continue
+			}
+			found = true
+
+			if permissionNode != nil {
+				applyGroupNode(ctx, primaryGroup, rank, *permissionNode)
+			}
+		}
+
+		if !found {
+			resultCh <- errNotFound
+			return
+		}
+		applyRankFallback(ctx, primaryGroup, rank)
+
+		resultCh <- RankInfo{
+			Group:  rankDisplayName(primaryGroup),
+			Title:  rank.Title,
+			Color:  rank.Color,
+			Weight: rank.Weight,
+		}
+	}()
+
+	select {
+	case result := <-resultCh:
+		if result == errNotFound {
+			writeResponse(w, http.StatusNotFound, "player or group not found")
+		} else if err, ok := result.(error); ok {
+			writeError(ctx, w, err, "failed to fetch player rank", "database access error")
+		} else {
+			writeResponse(w, http.StatusOK, result)
+		}
+	case <-ctx.Done():
+		writeContextError(ctx, w)
+	}
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+func TestHeavyQueriesRejectExcessRequests(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.StaffTimeout = duration{50 * time.Millisecond}
+	config.RestAPI.MaxBatchPlayers = 50
+
+	e, db := newFakeEndpoints(t)
+	db.fail("players p", errors.New("players query failed"))
+	e.heavyQueries = semaphore.NewWeighted(1)
+	// Stands for a request still running its query
+	if !e.heavyQueries.TryAcquire(1) {
+		t.Fatal("failed to take the only slot")
+	}
+
+	const requests = 4
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			e.HandlePlayers(w, httptest.NewRequest("GET", "/api/v1/players?names=mikroskeem", nil))
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %v, expected excess requests to be rejected at their timeout", elapsed)
+	}
+	for code := range codes {
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("got status %d, expected 503", code)
+		}
+	}
+	if queries := db.ran("players p"); len(queries) != 0 {
+		t.Errorf("%d player queries ran without a free slot", len(queries))
+	}
+
+	// Freed slot lets the next request through
+	e.heavyQueries.Release(1)
+	w := httptest.NewRecorder()
+	e.HandlePlayers(w, httptest.NewRequest("GET", "/api/v1/players?names=mikroskeem", nil))
+	if w.Code == http.StatusServiceUnavailable {
+		t.Error("request was rejected with a free slot")
+	}
+	if queries := db.ran("players p"); len(queries) != 1 {
+		t.Errorf("player query ran %d times, expected once", len(queries))
+	}
+}
+
+func TestHeavyQueriesSharedByStaffAndPlayers(t *testing.T) {
+	setupStaffTest(t, "admin")
+	config.RestAPI.StaffTimeout = duration{50 * time.Millisecond}
+	config.RestAPI.MaxBatchPlayers = 50
+
+	e, _ := newFakeEndpoints(t)
+	e.heavyQueries = semaphore.NewWeighted(1)
+	if !e.heavyQueries.TryAcquire(1) {
+		t.Fatal("failed to take the only slot")
+	}
+	defer e.heavyQueries.Release(1)
+
+	for name, request := range map[string]func(w http.ResponseWriter){
+		"staff": func(w http.ResponseWriter) {
+			e.HandleStaff(w, httptest.NewRequest("GET", "/api/v1/staff", nil))
+		},
+		"players": func(w http.ResponseWriter) {
+			e.HandlePlayers(w, httptest.NewRequest("GET", "/api/v1/players?names=mikroskeem", nil))
+		},
+	} {
+		w := httptest.NewRecorder()
+		request(w)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: got status %d, expected 503", name, w.Code)
+		}
+	}
+}
+
+func TestClientDisconnectCancelsQuery(t *testing.T) {
+	setupStaffTest(t, "admin")
+	config.RestAPI.VotersTimeout = duration{5 * time.Second}
+	config.RestAPI.StaffTimeout = duration{5 * time.Second}
+
+	cases := []struct {
+		name    string
+		url     string
+		handler func(e *Endpoints) http.HandlerFunc
+	}{
+		{"votes", "/api/v1/votes?limit=10", func(e *Endpoints) http.HandlerFunc { return e.HandleVoters }},
+		{"staff", "/api/v1/staff", func(e *Endpoints) http.HandlerFunc { return e.HandleStaff }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, db := newFakeEndpoints(t)
+			db.answer("", nil).delay = 5 * time.Second
+
+			ctx, cancel := context.WithCancel(context.Background())
+			r := httptest.NewRequest("GET", c.url, nil).WithContext(ctx)
+			time.AfterFunc(20*time.Millisecond, cancel)
+
+			w := httptest.NewRecorder()
+			start := time.Now()
+			c.handler(e)(w, r)
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("took %v, expected handler to give up when client went away", elapsed)
+			}
+			if w.Code != statusClientClosedRequest {
+				t.Errorf("got status %d, expected %d", w.Code, statusClientClosedRequest)
+			}
+
+			// Query goroutine notices cancellation on its own
+			for deadline := time.Now().Add(time.Second); db.cancelledQueries() == 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			if db.cancelledQueries() == 0 {
+				t.Error("database query was not cancelled")
+			}
+		})
+	}
+}
+
+func TestInternalErrorsStayOutOfResponses(t *testing.T) {
+	setupStaffTest(t, "admin")
+	config.RestAPI.VotersTimeout = duration{time.Second}
+
+	secret := errors.New("Error 1045: Access denied for user 'throne'@'10.0.0.5'")
+	cases := []struct {
+		name    string
+		url     string
+		handler func(e *Endpoints) http.HandlerFunc
+	}{
+		{"votes", "/api/v1/votes?limit=10", func(e *Endpoints) http.HandlerFunc { return e.HandleVoters }},
+		{"staff", "/api/v1/staff", func(e *Endpoints) http.HandlerFunc { return e.HandleStaff }},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, db := newFakeEndpoints(t)
+			db.fail("", secret)
+
+			w := httptest.NewRecorder()
+			c.handler(e)(w, httptest.NewRequest("GET", c.url, nil))
+
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("got status %d, expected %d", w.Code, http.StatusInternalServerError)
+			}
+			if body := w.Body.String(); strings.Contains(body, "Access denied") || strings.Contains(body, "10.0.0.5") {
+				t.Errorf("response leaks internal error: %s", body)
+			}
+		})
+	}
+}
+
+func TestWriteContextError(t *testing.T) {
+	timedOut, cancelTimedOut := context.WithTimeout(context.Background(), 0)
+	defer cancelTimedOut()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cases := []struct {
+		name   string
+		ctx    context.Context
+		status int
+	}{
+		{"timeout", timedOut, http.StatusGatewayTimeout},
+		{"client went away", cancelled, statusClientClosedRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			<-c.ctx.Done()
+
+			w := httptest.NewRecorder()
+			writeContextError(c.ctx, w)
+			if w.Code != c.status {
+				t.Errorf("got status %d, expected %d", w.Code, c.status)
+			}
+
+			// Query errors caused by the ending context are reported the same way
+			w = httptest.NewRecorder()
+			writeError(c.ctx, w, fmt.Errorf("query failed: %w", c.ctx.Err()), "failed", "database access error")
+			if w.Code != c.status {
+				t.Errorf("writeError: got status %d, expected %d", w.Code, c.status)
+			}
+		})
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	handler := encoderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, []string{"mikroskeem"})
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/votes", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q, expected 200 with ETag", w.Code, etag)
+	}
+
+	cases := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{etag, http.StatusNotModified},
+		{"W/" + etag, http.StatusNotModified},
+		{`"other", ` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/api/v1/votes", nil)
+		r.Header.Set("If-None-Match", c.ifNoneMatch)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d, expected %d", c.ifNoneMatch, w.Code, c.status)
+		}
+		if c.status == http.StatusNotModified && (w.Body.Len() != 0 || w.Header().Get("ETag") != etag) {
+			t.Errorf("%s: got body %q and ETag %q, expected only the ETag", c.ifNoneMatch, w.Body.String(), w.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestIfNoneMatchIgnoredForErrors(t *testing.T) {
+	handler := encoderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusNotFound, "not found")
+	}))
+
+	r := httptest.NewRequest("GET", "/api/v1/player/nobody", nil)
+	r.Header.Set("If-None-Match", "*")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, expected 404", w.Code)
+	}
+}
+
+func TestEncodeFailureLogHasRequestID(t *testing.T) {
+	logs := observeLogs(t)
+	handler := requestIDMiddleware(encoderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Channels can't be encoded
+		writeResponse(w, http.StatusOK, make(chan int))
+	})))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/version", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, expected 500", w.Code)
+	}
+	entries := logs.FilterMessage("failed to encode response").All()
+	if len(entries) != 1 || entries[0].ContextMap()["requestID"] != w.Header().Get("X-Request-ID") {
+		t.Errorf("got %v, expected encode failure logged with request ID %s", entries, w.Header().Get("X-Request-ID"))
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory stand-in for MySQL, answering queries whose SQL contains a registered substring.
+// Lets handlers run against canned rows, failures and slow queries without a database
+type fakeDB struct {
+	mu        sync.Mutex
+	answers   []*fakeAnswer
+	queries   []fakeQuery
+	running   int // Queries which have not returned yet
+	maxRan    int // Most queries running at once
+	cancelled int // Queries whose context ended while they ran
+}
+
+type fakeAnswer struct {
+	match    string
+	columns  []string
+	rows     [][]driver.Value
+	err      error
+	delay    time.Duration // How long the query takes to return, cut short by its context
+	rowDelay time.Duration // How long reading each row takes
+	panics   bool          // Panic instead of answering, standing for a bug in code running the query
+}
+
+// Query as seen by the database
+type fakeQuery struct {
+	sql  string
+	args []interface{}
+}
+
+// Answers queries containing match with given columns and rows
+func (db *fakeDB) answer(match string, columns []string, rows ...[]driver.Value) *fakeAnswer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	answer := &fakeAnswer{match: match, columns: columns, rows: rows}
+	db.answers = append(db.answers, answer)
+	return answer
+}
+
+// Fails queries containing match with err
+func (db *fakeDB) fail(match string, err error) *fakeAnswer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	answer := &fakeAnswer{match: match, err: err}
+	db.answers = append(db.answers, answer)
+	return answer
+}
+
+// Returns queries containing match, in order they were run
+func (db *fakeDB) ran(match string) []fakeQuery {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var ran []fakeQuery
+	for _, query := range db.queries {
+		if strings.Contains(query.sql, match) {
+			ran = append(ran, query)
+		}
+	}
+	return ran
+}
+
+func (db *fakeDB) maxConcurrent() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.maxRan
+}
+
+func (db *fakeDB) cancelledQueries() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.cancelled
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return fakeConn{db}, nil
+}
+
+func (db *fakeDB) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fake database is opened with sql.OpenDB")
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	db := c.db
+	db.mu.Lock()
+	recorded := fakeQuery{sql: query}
+	for _, arg := range args {
+		recorded.args = append(recorded.args, arg.Value)
+	}
+	db.queries = append(db.queries, recorded)
+
+	var answer *fakeAnswer
+	for _, candidate := range db.answers {
+		if strings.Contains(query, candidate.match) {
+			answer = candidate
+			break
+		}
+	}
+	db.running++
+	if db.running > db.maxRan {
+		db.maxRan = db.running
+	}
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		db.running--
+		db.mu.Unlock()
+	}()
+
+	if answer == nil {
+		return nil, fmt.Errorf("fake database has no answer for query: %s", query)
+	}
+
+	if answer.delay > 0 {
+		select {
+		case <-time.After(answer.delay):
+		case <-ctx.Done():
+			db.mu.Lock()
+			db.cancelled++
+			db.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+
+	if answer.panics {
+		panic("fake database query panicked")
+	}
+	if answer.err != nil {
+		return nil, answer.err
+	}
+	return &fakeRows{answer: answer}, nil
+}
+
+type fakeRows struct {
+	answer *fakeAnswer
+	next   int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.answer.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.answer.rows) {
+		return io.EOF
+	}
+	if r.answer.rowDelay > 0 {
+		time.Sleep(r.answer.rowDelay)
+	}
+	copy(dest, r.answer.rows[r.next])
+	r.next++
+	return nil
+}
+
+// Endpoints backed by a fresh fake database
+func newFakeEndpoints(t testing.TB) (*Endpoints, *fakeDB) {
+	fake := &fakeDB{}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return &Endpoints{
+		db:          db,
+		readDB:      db,
+		staffCache:  newResponseCache("staff", 0, 0),
+		votersCache: newResponseCache("votes", 0, 0),
+		statsCache:  newResponseCache("stats", 0, 0),
+	}, fake
+}
+
+// Builds a canned row, reads better than a []driver.Value literal
+func row(values ...driver.Value) []driver.Value {
+	return values
+}
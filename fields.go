@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Limits serialized fields of a response struct type, requested with "fields" query parameter
+type fieldMask struct {
+	target reflect.Type
+	fields map[string]bool
+}
+
+// Parses comma separated "fields" query parameter for responses built from target structs.
+// Returns nil mask when all fields are wanted, and false if the request was rejected and
+// response is already written. Unknown fields are ignored unless strict_query_params is enabled
+func parseFields(w http.ResponseWriter, r *http.Request, target interface{}) (*fieldMask, bool) {
+	fieldsStr := r.URL.Query().Get("fields")
+	if fieldsStr == "" {
+		return nil, true
+	}
+
+	mask := &fieldMask{
+		target: reflect.TypeOf(target),
+		fields: map[string]bool{},
+	}
+
+	known := map[string]bool{}
+	for i := 0; i < mask.target.NumField(); i++ {
+		if name, _, ok := jsonField(mask.target.Field(i)); ok {
+			known[name] = true
+		}
+	}
+
+	for _, field := range strings.Split(fieldsStr, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		if !known[field] {
+			if config.RestAPI.StrictQueryParams {
+				writeResponse(w, http.StatusBadRequest, fmt.Sprintf("unknown field: %s", field))
+				return nil, false
+			}
+			continue
+		}
+
+		mask.fields[field] = true
+	}
+
+	return mask, true
+}
+
+// Returns value with target structs replaced by maps holding only the requested fields.
+// Nil mask returns value as is
+func (m *fieldMask) apply(value interface{}) interface{} {
+	if m == nil {
+		return value
+	}
+	return m.walk(reflect.ValueOf(value))
+}
+
+func (m *fieldMask) walk(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return m.walk(v.Elem())
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String || !m.contains(v.Type().Elem()) {
+			return v.Interface()
+		}
+
+		result := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			result[iter.Key().String()] = m.walk(iter.Value())
+		}
+		return result
+	case reflect.Slice, reflect.Array:
+		if (v.Kind() == reflect.Slice && v.IsNil()) || !m.contains(v.Type().Elem()) {
+			return v.Interface()
+		}
+
+		result := make([]interface{}, v.Len())
+		for i := range result {
+			result[i] = m.walk(v.Index(i))
+		}
+		return result
+	case reflect.Struct:
+		if v.Type() != m.target && !m.contains(v.Type()) {
+			return v.Interface()
+		}
+
+		result := map[string]interface{}{}
+		for i := 0; i < v.NumField(); i++ {
+			name, omitEmpty, ok := jsonField(v.Type().Field(i))
+			if !ok || (v.Type() == m.target && !m.fields[name]) {
+				continue
+			}
+
+			field := v.Field(i)
+			if omitEmpty && field.IsZero() {
+				continue
+			}
+
+			if v.Type() == m.target {
+				result[name] = field.Interface()
+			} else {
+				result[name] = m.walk(field)
+			}
+		}
+		return result
+	default:
+		return v.Interface()
+	}
+}
+
+// Whether values of type t can hold target structs which need masking
+func (m *fieldMask) contains(t reflect.Type) bool {
+	return m.containsSeen(t, map[reflect.Type]bool{})
+}
+
+func (m *fieldMask) containsSeen(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if t == m.target {
+		return true
+	}
+	if seen[t] || t.Implements(reflect.TypeOf((*json.Marshaler)(nil)).Elem()) {
+		return false
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Array:
+		return m.containsSeen(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if _, _, ok := jsonField(t.Field(i)); ok && m.containsSeen(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns JSON name of a struct field and whether it has omitempty. Unexported and
+// ignored fields are not serialized
+func jsonField(field reflect.StructField) (string, bool, bool) {
+	if field.PkgPath != "" {
+		return "", false, false
+	}
+
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+
+	parts := strings.Split(tag, ",")
+	name := parts[0]
+	if name == "" {
+		name = field.Name
+	}
+
+	omitEmpty := false
+	for _, option := range parts[1:] {
+		if option == "omitempty" {
+			omitEmpty = true
+		}
+	}
+
+	return name, omitEmpty, true
+}
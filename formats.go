@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const csvContentType = "text/csv; charset=utf-8"
+
+const (
+	jsonFormat = "json"
+	csvFormat  = "csv"
+)
+
+// Response bodies which can be serialized as CSV
+type csvRecords interface {
+	CSVHeader() []string
+	CSVRecords() [][]string
+}
+
+// Picks response format from "format" query parameter, falling back to Accept header. Defaults to JSON
+func negotiateFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		switch format {
+		case jsonFormat, csvFormat:
+			return format, nil
+		default:
+			return "", fmt.Errorf("invalid format: %s", format)
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		return csvFormat, nil
+	}
+
+	return jsonFormat, nil
+}
+
+// Writes CSV with 200 status, honoring Range requests. Ranges are served from the
+// fully rendered CSV, which takes as much memory as a regular buffered response. Every range request
+// queries and renders the whole CSV again unless votes are cached, and If-Range with the ETag keeps
+// a resumed download from mixing up two different versions of it
+func writeRangedCSVResponse(w http.ResponseWriter, r *http.Request, body csvRecords) {
+	rendered := renderCSV(body)
+	setCommonHeaders(w, csvContentType)
+	w.Header().Set("ETag", bodyETag(rendered))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(rendered))
+}
+
+func renderCSV(body csvRecords) []byte {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(body.CSVHeader())
+	writer.WriteAll(body.CSVRecords())
+	return buf.Bytes()
+}
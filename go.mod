@@ -1,11 +1,16 @@
 module github.com/mikroskeem/throne-api
 
-go 1.12
+go 1.16
 
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/go-sql-driver/mysql v1.4.1
+	github.com/google/uuid v1.1.4
 	github.com/gorilla/mux v1.7.3
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	go.uber.org/zap v1.13.0
+	golang.org/x/sync v0.0.0-20220907140024-f12130a52804
+	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	google.golang.org/appengine v1.6.5 // indirect
 )
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Pings database until it responds or maxWait has passed, backing off between attempts
+func waitForDatabase(db *sql.DB, name string, maxWait time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+
+		zap.L().Warn("database is not reachable, retrying", zap.String("database", name), zap.Duration("backoff", backoff), zap.Error(err))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// Periodically pings databases, so that requests can be turned away with 503 while they are down.
+// Connection pool reconnects by itself once database is back
+type databaseMonitor struct {
+	dbs       []*sql.DB
+	available int32
+}
+
+func newDatabaseMonitor(available bool, dbs ...*sql.DB) *databaseMonitor {
+	m := &databaseMonitor{dbs: dbs}
+	m.setAvailable(available)
+	return m
+}
+
+func (m *databaseMonitor) Available() bool {
+	return atomic.LoadInt32(&m.available) == 1
+}
+
+func (m *databaseMonitor) setAvailable(available bool) {
+	var value int32
+	if available {
+		value = 1
+	}
+	if atomic.SwapInt32(&m.available, value) != value {
+		if available {
+			zap.L().Info("database is reachable")
+		} else {
+			zap.L().Warn("database became unreachable")
+		}
+	}
+}
+
+func (m *databaseMonitor) Run(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		available := true
+		for _, db := range m.dbs {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := db.PingContext(ctx)
+			cancel()
+			if err != nil {
+				available = false
+				break
+			}
+		}
+		m.setAvailable(available)
+	}
+}
+
+// Answers with 503 while database is down. Endpoints not touching the database and static files are let through
+func (m *databaseMonitor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.Available() && strings.HasPrefix(r.URL.Path, "/api/") && !strings.HasPrefix(r.URL.Path, "/api/v1/admin/") &&
+			r.URL.Path != "/api/v1/version" && r.URL.Path != "/api/v1/openapi.json" {
+			writeResponse(w, http.StatusServiceUnavailable, "database unavailable")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
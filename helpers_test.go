@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// Restores global configuration after the test, so that tests can change it freely. Only changed
+// fields are written back, as goroutines the test left behind, like queries abandoned at a timeout,
+// may still be reading other ones
+func restoreConfig(t testing.TB) {
+	saved := config
+	t.Cleanup(func() {
+		restoreChanged(reflect.ValueOf(&config).Elem(), reflect.ValueOf(saved))
+	})
+}
+
+func restoreChanged(current reflect.Value, saved reflect.Value) {
+	if current.Kind() == reflect.Struct {
+		for i := 0; i < current.NumField(); i++ {
+			restoreChanged(current.Field(i), saved.Field(i))
+		}
+		return
+	}
+	if !reflect.DeepEqual(current.Interface(), saved.Interface()) {
+		current.Set(saved)
+	}
+}
+
+// Replaces configured staff groups for the duration of the test
+func setStaffGroups(t *testing.T, rankNames ...string) {
+	saved := checkedRankNames
+	t.Cleanup(func() {
+		checkedRankNames = saved
+	})
+
+	checkedRankNames = map[string]bool{}
+	for _, rankName := range rankNames {
+		checkedRankNames[rankName] = true
+	}
+}
+
+// Captures entries logged through the global logger for the duration of the test
+func observeLogs(t *testing.T) *observer.ObservedLogs {
+	core, logs := observer.New(zapcore.DebugLevel)
+	restore := zap.ReplaceGlobals(zap.New(core))
+	t.Cleanup(restore)
+	return logs
+}
@@ -0,0 +1,294 @@
+//go:build integration
+// +build integration
+
+// Integration tests running the API server against a real MySQL seeded with LuckPerms, BenjiAuth
+// and Confetti schemas, catching what canned query answers can't, like broken cross-database
+// subqueries. They need Docker and are left out of regular test runs:
+//
+//	cd integration && go test -tags integration .
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+const mysqlPassword = "throne"
+
+// Configuration of the API server under test, filled with its listen address and database url
+const configTemplate = `
+[rest_api]
+listen_address = %q
+debug_pretty = true
+
+[database]
+database_url = %q
+luckperms_database_name = "luckperms"
+luckperms_table_prefix = "luckperms_"
+confetti_database_name = "confetti"
+confetti_votes_table_name = "votes"
+benjiauth_database_name = "benjiauth"
+benjiauth_users_table_name = "users"
+staff_group_names = ["admin", "mod", "helper"]
+
+[logging]
+level = "warn"
+`
+
+// Base URL of the API server under test
+var apiURL string
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+// Sets up MySQL and the API server, and tears them down once tests are done
+func run(m *testing.M) int {
+	ctx := context.Background()
+
+	dsn, stopMySQL, err := startMySQL(ctx)
+	if err != nil {
+		log.Printf("failed to start mysql: %v", err)
+		return 1
+	}
+	defer stopMySQL()
+
+	if err := seed(dsn); err != nil {
+		log.Printf("failed to seed database: %v", err)
+		return 1
+	}
+
+	stopServer, err := startServer(dsn)
+	if err != nil {
+		log.Printf("failed to start api server: %v", err)
+		return 1
+	}
+	defer stopServer()
+
+	return m.Run()
+}
+
+// Starts MySQL container, returning its connection string without a database name
+func startMySQL(ctx context.Context) (string, func(), error) {
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "mysql:8.0",
+			ExposedPorts: []string{"3306/tcp"},
+			Env:          map[string]string{"MYSQL_ROOT_PASSWORD": mysqlPassword},
+			// Entrypoint runs a temporary server for initialization first, the second one is for real
+			WaitingFor: wait.ForLog("ready for connections").WithOccurrence(2).WithStartupTimeout(3 * time.Minute),
+		},
+		Started: true,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	stop := func() {
+		container.Terminate(context.Background())
+	}
+
+	host, err := container.Host(ctx)
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+	port, err := container.MappedPort(ctx, "3306")
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+
+	return fmt.Sprintf("root:%s@tcp(%s)/", mysqlPassword, net.JoinHostPort(host, port.Port())), stop, nil
+}
+
+func seed(dsn string) error {
+	schema, err := ioutil.ReadFile(filepath.Join("testdata", "schema.sql"))
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("mysql", dsn+"?multiStatements=true")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(string(schema))
+	return err
+}
+
+// Builds the API server from the parent directory and runs it against given database until it answers
+func startServer(dsn string) (func(), error) {
+	dir, err := ioutil.TempDir("", "throne-api-integration")
+	if err != nil {
+		return nil, err
+	}
+
+	binary := filepath.Join(dir, "throne-api")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = ".."
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to build api server: %w", err)
+	}
+
+	address, err := freeAddress()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	configPath := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(configPath, []byte(fmt.Sprintf(configTemplate, address, dsn)), 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	server := exec.Command(binary, "-config", configPath)
+	server.Stdout, server.Stderr = os.Stdout, os.Stderr
+	if err := server.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	stop := func() {
+		server.Process.Kill()
+		server.Wait()
+		os.RemoveAll(dir)
+	}
+
+	apiURL = "http://" + address + "/api/v1"
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if response, err := http.Get(apiURL + "/version"); err == nil {
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				return stop, nil
+			}
+		}
+	}
+
+	stop()
+	return nil, errors.New("api server did not start answering in time")
+}
+
+// Returns a local address nothing is listening on
+func freeAddress() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
+
+// Responses of every data endpoint, compared by their decoded data
+func TestEndpoints(t *testing.T) {
+	cases := []struct {
+		name   string
+		path   string
+		status int
+		data   string
+	}{
+		{"voters", "/votes", http.StatusOK, `{
+			"voters": [
+				{"voter_name": "mikroskeem", "votes": 42, "last_vote_timestamp": 1590000000},
+				{"voter_name": "notch", "votes": 7, "last_vote_timestamp": 1590000100},
+				{"voter_name": "steve", "votes": 5, "last_vote_timestamp": 1589990000},
+				{"voter_name": "jeb_", "votes": 1, "last_vote_timestamp": 1580000000}
+			],
+			"pagination": {"limit": 0, "offset": 0, "total": 4, "has_more": false}
+		}`},
+		{"voters_page", "/votes?limit=2&offset=1", http.StatusOK, `{
+			"voters": [
+				{"voter_name": "notch", "votes": 7, "last_vote_timestamp": 1590000100},
+				{"voter_name": "steve", "votes": 5, "last_vote_timestamp": 1589990000}
+			],
+			"pagination": {"limit": 2, "offset": 1, "total": 4, "has_more": true}
+		}`},
+		{"voters_search", "/votes?search=mik", http.StatusOK, `{
+			"voters": [
+				{"voter_name": "mikroskeem", "votes": 42, "last_vote_timestamp": 1590000000}
+			],
+			"pagination": {"limit": 0, "offset": 0, "total": 1, "has_more": false}
+		}`},
+		{"votes_summary", "/votes/summary", http.StatusOK, `{"total_votes": 55, "total_voters": 4, "last_vote": 1590000100}`},
+		{"staff", "/staff", http.StatusOK, `{
+			"admin": {"title": "[Admin]", "color": "#FF5555", "weight": 100, "members": ["Notch"]},
+			"mod": {"title": "Moderator", "color": "#55FF55", "weight": 50, "members": ["jeb_", "mikroskeem"]}
+		}`},
+		{"staff_groups", "/staff/groups", http.StatusOK, `{
+			"admin": {"title": "[Admin]", "color": "#FF5555", "weight": 100},
+			"mod": {"title": "Moderator", "color": "#55FF55", "weight": 50},
+			"helper": {"title": "Helper", "color": "", "weight": 10}
+		}`},
+		{"staff_group", "/staff/mod", http.StatusOK, `{"title": "Moderator", "color": "#55FF55", "weight": 50, "members": ["jeb_", "mikroskeem"]}`},
+		{"staff_member", "/staff/member/jeb_", http.StatusOK, `[{"group": "mod", "title": "Moderator", "color": "#55FF55", "weight": 50}]`},
+		{"player", "/player/notch", http.StatusOK, `{
+			"name": "Notch", "uuid": "069a79f4-44e9-4726-a5be-fca90e38aaf5", "primary_group": "admin",
+			"votes": 7, "last_vote_timestamp": 1590000100
+		}`},
+		{"player_not_found", "/player/herobrine", http.StatusNotFound, `"player not found"`},
+		{"player_rank", "/player/mikroskeem/rank", http.StatusOK, `{"group": "mod", "title": "Moderator", "color": "#55FF55", "weight": 50}`},
+		{"player_rank_position", "/player/steve/rank-position", http.StatusOK, `{"voter_name": "steve", "position": 3, "votes": 5}`},
+		{"players", "/players?names=notch,steve,herobrine", http.StatusOK, `{
+			"notch": {
+				"name": "Notch", "uuid": "069a79f4-44e9-4726-a5be-fca90e38aaf5", "primary_group": "admin",
+				"votes": 7, "last_vote_timestamp": 1590000100
+			},
+			"steve": {
+				"name": "Steve", "uuid": "8667ba71-b85a-4004-af54-457a9734eed7", "primary_group": "default",
+				"votes": 5, "last_vote_timestamp": 1589990000
+			}
+		}`},
+		{"stats", "/stats", http.StatusOK, `{"total_votes": 55, "total_voters": 4, "staff_groups": 2, "staff_members": 3}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response, err := http.Get(apiURL + c.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+
+			body, err := ioutil.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != c.status {
+				t.Fatalf("got status %d, expected %d: %s", response.StatusCode, c.status, body)
+			}
+
+			var got struct {
+				Data interface{} `json:"data"`
+			}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("failed to decode response: %v: %s", err, body)
+			}
+			var expected interface{}
+			if err := json.Unmarshal([]byte(c.data), &expected); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Data, expected) {
+				t.Errorf("got:\n%s\nexpected data:\n%s", body, c.data)
+			}
+		})
+	}
+}
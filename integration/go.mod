@@ -0,0 +1,8 @@
+module github.com/mikroskeem/throne-api/integration
+
+go 1.16
+
+require (
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/testcontainers/testcontainers-go v0.14.0
+)
@@ -0,0 +1,88 @@
+-- Schemas of LuckPerms, BenjiAuth and Confetti as far as the API reads them, with a few players.
+-- Group "helper" is configured as staff but has no members, and jeb_ is in "mod" through a
+-- permission node only
+
+create database luckperms;
+
+create table luckperms.luckperms_players (
+  uuid varchar(36) not null primary key,
+  username varchar(16) not null,
+  primary_group varchar(36) not null
+);
+
+create table luckperms.luckperms_groups (
+  name varchar(36) not null primary key
+);
+
+create table luckperms.luckperms_user_permissions (
+  id int auto_increment not null primary key,
+  uuid varchar(36) not null,
+  permission varchar(200) not null,
+  value bool not null,
+  server varchar(36) not null,
+  world varchar(64) not null,
+  expiry bigint not null,
+  contexts varchar(200) not null
+);
+
+create table luckperms.luckperms_group_permissions (
+  id int auto_increment not null primary key,
+  name varchar(36) not null,
+  permission varchar(200) not null,
+  value bool not null,
+  server varchar(36) not null,
+  world varchar(64) not null,
+  expiry bigint not null,
+  contexts varchar(200) not null
+);
+
+insert into luckperms.luckperms_groups (name) values ('default'), ('admin'), ('mod'), ('helper');
+
+insert into luckperms.luckperms_players (uuid, username, primary_group) values
+  ('069a79f4-44e9-4726-a5be-fca90e38aaf5', 'notch', 'admin'),
+  ('853c80ef-3c37-49fd-aa49-938b674adae6', 'jeb_', 'default'),
+  ('2f6d1b6e-0c8a-4a4e-9e0b-6a9f3b1c7d21', 'mikroskeem', 'mod'),
+  ('8667ba71-b85a-4004-af54-457a9734eed7', 'steve', 'default');
+
+insert into luckperms.luckperms_user_permissions (uuid, permission, value, server, world, expiry, contexts) values
+  ('853c80ef-3c37-49fd-aa49-938b674adae6', 'group.mod', true, 'global', 'global', 0, '{}'),
+  ('8667ba71-b85a-4004-af54-457a9734eed7', 'group.default', true, 'global', 'global', 0, '{}'),
+  ('8667ba71-b85a-4004-af54-457a9734eed7', 'essentials.fly', true, 'global', 'global', 0, '{}');
+
+insert into luckperms.luckperms_group_permissions (name, permission, value, server, world, expiry, contexts) values
+  ('admin', 'prefix.100.&c[Admin]', true, 'global', 'global', 0, '{}'),
+  ('admin', 'weight.100', true, 'global', 'global', 0, '{}'),
+  ('mod', 'prefix.50.<green>Moderator', true, 'global', 'global', 0, '{}'),
+  ('mod', 'meta.weight.50', true, 'global', 'global', 0, '{}'),
+  ('helper', 'displayname.Helper', true, 'global', 'global', 0, '{}'),
+  ('helper', 'weight.10', true, 'global', 'global', 0, '{}');
+
+create database benjiauth;
+
+create table benjiauth.users (
+  id int auto_increment not null primary key,
+  uuid varchar(36) not null,
+  username varchar(16) not null unique,
+  original_username varchar(16) not null
+);
+
+insert into benjiauth.users (uuid, username, original_username) values
+  ('069a79f4-44e9-4726-a5be-fca90e38aaf5', 'notch', 'Notch'),
+  ('2f6d1b6e-0c8a-4a4e-9e0b-6a9f3b1c7d21', 'mikroskeem', 'mikroskeem'),
+  ('8667ba71-b85a-4004-af54-457a9734eed7', 'steve', 'Steve');
+
+create database confetti;
+
+create table confetti.votes (
+  voter_name varchar(16) not null,
+  votes int not null,
+  last_vote_timestamp bigint not null
+);
+
+-- Steve has two rows, which the API collapses into one
+insert into confetti.votes (voter_name, votes, last_vote_timestamp) values
+  ('mikroskeem', 42, 1590000000),
+  ('notch', 7, 1590000100),
+  ('steve', 3, 1589990000),
+  ('steve', 2, 1589000000),
+  ('jeb_', 1, 1580000000);
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Rejects requests with too long URLs or bodies. Zero limits are not enforced
+func requestSizeLimits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxLength := config.RestAPI.MaxURLLength; maxLength > 0 && len(r.URL.RequestURI()) > maxLength {
+			writeResponse(w, http.StatusRequestURITooLong, "request url too long")
+			return
+		}
+
+		if maxSize := config.RestAPI.MaxBodySize; maxSize > 0 {
+			if r.ContentLength > maxSize {
+				writeResponse(w, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+
+			// Content-Length might be missing or lie, so cap reading as well
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Whether err comes from reading past the body limit of requestSizeLimits. MaxBytesReader has
+// no error type of its own to check for
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
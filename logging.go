@@ -0,0 +1,31 @@
+package main
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Builds logger as configured in logging section. Invalid level falls back to info
+func buildLogger(cfg loggingConfig) (*zap.Logger, error) {
+	zapConfig := zap.NewProductionConfig()
+	if cfg.Development {
+		zapConfig = zap.NewDevelopmentConfig()
+	}
+
+	var level zapcore.Level
+	levelErr := level.UnmarshalText([]byte(cfg.Level))
+	if levelErr != nil {
+		level = zapcore.InfoLevel
+	}
+	zapConfig.Level = zap.NewAtomicLevelAt(level)
+
+	logger, err := zapConfig.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if levelErr != nil {
+		logger.Warn("invalid logging level, falling back to info", zap.String("level", cfg.Level))
+	}
+	return logger, nil
+}
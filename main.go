@@ -4,23 +4,39 @@ import (
 	"context"
 	"database/sql"
 	"flag"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
 )
 
 var (
 	configFileName   string
 	config           throneAPIConfig
 	checkedRankNames = make(map[string]bool)
+	displayLocation  = time.UTC
+	startTime        = time.Now()
 	chatColorRegexp  = regexp.MustCompile("(?i)[&§][0-9A-FK-OR]")
 	chatColorsToHex  = map[string]string{
 		"0": "#000000",
@@ -52,10 +68,52 @@ func main() {
 	} else {
 		panic(err)
 	}
-	defer zap.L().Sync()
+	defer func() { zap.L().Sync() }()
 	zap.L().Info("hello world")
 
 	// Load configuration
+	config.RestAPI.VotersTimeout = duration{3 * time.Second}
+	config.RestAPI.StaffTimeout = duration{5 * time.Second}
+	config.RestAPI.PartialResponseMargin = duration{500 * time.Millisecond}
+	config.RestAPI.StatsCacheTTL = duration{30 * time.Second}
+	config.RestAPI.CacheMaxEntries = 1000
+	config.RestAPI.MaxBatchPlayers = 50
+	config.RestAPI.MaxBatchOperations = 10
+	config.RestAPI.MaxURLLength = 4096
+	config.RestAPI.MaxBodySize = 1 << 20
+	config.RestAPI.SocketMode = "0660"
+	config.RestAPI.StaffCacheControl = "no-store"
+	config.RestAPI.VotesCacheControl = "no-store"
+	config.RestAPI.RecoverPanics = true
+	config.Logging.Level = "info"
+	config.Endpoints = endpointsConfig{
+		Votes:   true,
+		Staff:   true,
+		Player:  true,
+		OpenAPI: true,
+	}
+	config.Database.Pool = databasePoolConfig{
+		MaxOpenConns:    32,
+		MaxIdleConns:    64,
+		ConnMaxLifetime: duration{5 * time.Minute},
+	}
+	config.Database.ReadPool = config.Database.Pool
+	config.Database.LastSeenColumn = "last_seen"
+	config.Database.LastSeenUUIDColumn = "uuid"
+	config.Database.BenjiAuthHistoryUUIDColumn = "uuid"
+	config.Database.BenjiAuthHistoryNameColumn = "username"
+	config.Database.ConfettiEventsVoterColumn = "voter_name"
+	config.Database.ConfettiEventsTimestampColumn = "timestamp"
+	config.Database.MemberSort = memberSortName
+	config.Database.ColorStrategy = colorStrategyLast
+	config.Database.DefaultGroupName = "default"
+	config.Database.UsernameSource = usernameSourceBenjiAuth
+	config.Database.AuthMeTableName = "authme"
+	config.Database.AuthMeNameColumn = "username"
+	config.Database.AuthMeRealNameColumn = "realname"
+	config.Database.StartupWait = duration{time.Minute}
+	config.Database.HealthCheckInterval = duration{5 * time.Second}
+
 	var rawConfig []byte
 	if rawConfig, err = ioutil.ReadFile(configFileName); err != nil {
 		zap.L().Panic("failed to read configuration", zap.Error(err))
@@ -65,35 +123,244 @@ func main() {
 		zap.L().Panic("failed to parse configuration", zap.Error(err))
 	}
 
+	// Replace startup logger with the configured one
+	if logger, err := buildLogger(config.Logging); err == nil {
+		zap.L().Sync()
+		zap.ReplaceGlobals(logger)
+	} else {
+		zap.L().Panic("failed to set up logging", zap.Error(err))
+	}
+
+	if config.RestAPI.DisplayTimezone != "" {
+		if displayLocation, err = time.LoadLocation(config.RestAPI.DisplayTimezone); err != nil {
+			zap.L().Panic("invalid display timezone", zap.String("timezone", config.RestAPI.DisplayTimezone), zap.Error(err))
+		}
+	}
+
+	if config.RestAPI.TrustForwardedFor {
+		zap.L().Warn("trust_forwarded_for is deprecated and only trusts local peers now, list reverse proxies in trusted_proxies instead")
+		config.RestAPI.TrustedProxies = append(config.RestAPI.TrustedProxies, "127.0.0.0/8", "::1", "unix")
+	}
+	if trustedProxies, trustUnixPeers, err = parseTrustedProxies(config.RestAPI.TrustedProxies); err != nil {
+		zap.L().Panic("invalid trusted_proxies", zap.Error(err))
+	}
+
+	if config.RestAPI.CORSAllowCredentials && config.RestAPI.CORSOrigins == "*" {
+		zap.L().Warn("cors_allow_credentials does not work with \"*\" cors_origin, browsers will reject credentialed requests")
+	}
+
+	switch config.RestAPI.EmptyData {
+	case emptyDataAsIs, emptyDataNull, emptyDataEmpty, emptyDataOmit:
+	default:
+		zap.L().Panic("invalid empty_data", zap.String("emptyData", config.RestAPI.EmptyData))
+	}
+
+	if config.RestAPI.AvatarURLTemplate != "" && config.Database.BenjiAuthUUIDColumn == "" {
+		zap.L().Warn("avatar_url_template is set but benjiauth_uuid_column is not, voters will have no avatar urls")
+	}
+
+	switch config.Database.MemberSort {
+	case memberSortName:
+	case memberSortLastSeen:
+		if config.Database.LastSeenTable == "" {
+			zap.L().Warn("member_sort is last_seen but last_seen_table is not set, members will be sorted by name")
+		}
+	default:
+		zap.L().Panic("invalid member_sort", zap.String("memberSort", config.Database.MemberSort))
+	}
+
+	switch config.Database.UsernameSource {
+	case usernameSourceBenjiAuth, usernameSourceLuckPerms:
+	case usernameSourceAuthMe:
+		if config.Database.AuthMeDatabaseName == "" {
+			zap.L().Panic("username_source is authme but authme_database_name is not set")
+		}
+	default:
+		zap.L().Panic("invalid username_source", zap.String("usernameSource", config.Database.UsernameSource))
+	}
+
+	switch config.Database.ColorStrategy {
+	case colorStrategyLast, colorStrategyFirst, colorStrategyDominant:
+	default:
+		zap.L().Panic("invalid color_strategy", zap.String("colorStrategy", config.Database.ColorStrategy))
+	}
+
+	for _, milestone := range config.RestAPI.VoteMilestones {
+		if milestone <= 0 {
+			zap.L().Panic("invalid vote milestone, must be positive", zap.Int("milestone", milestone))
+		}
+	}
+	sort.Ints(config.RestAPI.VoteMilestones)
+
+	// Merge custom colors over vanilla ones
+	for code, hexColor := range config.Colors {
+		code = strings.ToLower(code)
+		if _, ok := chatColorsToHex[code]; !ok {
+			zap.L().Panic("invalid color code in colors", zap.String("code", code))
+		}
+		if !hexColorRegexp.MatchString(hexColor) {
+			zap.L().Panic("invalid hex color in colors", zap.String("code", code), zap.String("color", hexColor))
+		}
+		chatColorsToHex[code] = strings.ToUpper(hexColor)
+	}
+
 	// Put together rank names map for easier checking
-	for _, rankName := range config.Database.StaffGroupNames {
-		checkedRankNames[rankName] = true
+	checkedRankNames = staffRankNames(config.Database.StaffGroupNames, config.Database.DefaultGroupName)
+	rankAliases := map[string]string{}
+	for rankName, alias := range config.RankAliases {
+		rankAliases[normalizeGroupName(rankName)] = alias
 	}
+	config.RankAliases = rankAliases
 
 	// Connect to the database
+	var dsn string
+	if dsn, err = config.Database.DSN(); err != nil {
+		zap.L().Panic("failed to build database connection string", zap.Error(err))
+	}
+
 	var db *sql.DB
-	if db, err = sql.Open("mysql", config.Database.DatabaseURL); err != nil {
+	if db, err = openDatabase(dsn, config.Database.Pool); err != nil {
 		zap.L().Panic("failed to open database connection", zap.Error(err))
 	}
-	db.SetMaxOpenConns(32)
-	db.SetMaxIdleConns(64)
-	db.SetConnMaxLifetime(5 * time.Minute)
 	defer db.Close()
 
-	// Test databse connection
-	if err := db.Ping(); err != nil {
-		zap.L().Panic("failed to test database connection", zap.Error(err))
+	// Test databse connection. Keep going when it's down, requests get 503 until it's back
+	databaseAvailable := true
+	if err := waitForDatabase(db, "primary", config.Database.StartupWait.Duration); err != nil {
+		zap.L().Error("failed to test database connection, starting without it", zap.Error(err))
+		databaseAvailable = false
 	} else {
 		zap.L().Info("database connection works")
 	}
 
-	endpoints := Endpoints{db: db}
+	// Connect to the read replica, if configured
+	readDB := db
+	if config.Database.ReadDatabaseURL != "" {
+		var readDSN string
+		if readDSN, err = config.Database.ReadDSN(); err != nil {
+			zap.L().Panic("failed to build read database connection string", zap.Error(err))
+		}
+
+		if readDB, err = openDatabase(readDSN, config.Database.ReadPool); err != nil {
+			zap.L().Panic("failed to open read database connection", zap.Error(err))
+		}
+		defer readDB.Close()
+
+		if err := waitForDatabase(readDB, "read", config.Database.StartupWait.Duration); err != nil {
+			zap.L().Error("failed to test read database connection, starting without it", zap.Error(err))
+			databaseAvailable = false
+		} else {
+			zap.L().Info("read database connection works")
+		}
+	}
+
+	monitoredDBs := []*sql.DB{db}
+	if readDB != db {
+		monitoredDBs = append(monitoredDBs, readDB)
+	}
+	monitor := newDatabaseMonitor(databaseAvailable, monitoredDBs...)
+	go monitor.Run(config.Database.HealthCheckInterval.Duration)
+
+	endpoints := Endpoints{
+		db:          db,
+		readDB:      readDB,
+		staffCache:  newResponseCache("staff", config.RestAPI.StaffCacheTTL.Duration, config.RestAPI.CacheMaxEntries),
+		votersCache: newResponseCache("votes", config.RestAPI.VotersCacheTTL.Duration, config.RestAPI.CacheMaxEntries),
+		statsCache:  newResponseCache("stats", config.RestAPI.StatsCacheTTL.Duration, config.RestAPI.CacheMaxEntries),
+	}
+
+	go endpoints.checkStaffGroupsExist()
+
+	if config.RestAPI.MaxConcurrentQueries > 0 {
+		endpoints.heavyQueries = semaphore.NewWeighted(int64(config.RestAPI.MaxConcurrentQueries))
+	}
+
+	if config.RestAPI.WarmupOnStart {
+		if endpoints.staffCache.Enabled() {
+			go endpoints.warmupStaffCache()
+		} else {
+			zap.L().Warn("warmup_on_start is set but staff cache is disabled, skipping warmup")
+		}
+	}
 
 	// Set up HTTP server
 	router := mux.NewRouter()
-	router.HandleFunc("/api/v1/votes", endpoints.HandleVoters)
-	router.HandleFunc("/api/v1/staff", endpoints.HandleStaff)
-	router.HandleFunc("/api/v1/player/{player}", endpoints.HandlePlayer)
+	// Disabled endpoints are left unregistered and answer with 404
+	if config.Endpoints.Votes {
+		router.HandleFunc("/api/v1/votes", withCacheControl(config.RestAPI.VotesCacheControl, endpoints.HandleVoters)).Methods(http.MethodGet, http.MethodHead)
+		router.HandleFunc("/api/v1/votes/summary", withCacheControl(config.RestAPI.VotesCacheControl, endpoints.HandleVotesSummary)).Methods(http.MethodGet, http.MethodHead)
+	}
+	if config.Endpoints.Staff {
+		router.HandleFunc("/api/v1/staff", withCacheControl(config.RestAPI.StaffCacheControl, endpoints.HandleStaff)).Methods(http.MethodGet, http.MethodHead)
+		router.HandleFunc("/api/v1/staff/groups", withCacheControl(config.RestAPI.StaffCacheControl, endpoints.HandleStaffGroups)).Methods(http.MethodGet, http.MethodHead)
+		router.HandleFunc("/api/v1/staff/{group}", withCacheControl(config.RestAPI.StaffCacheControl, endpoints.HandleStaffGroup)).Methods(http.MethodGet, http.MethodHead)
+		router.HandleFunc("/api/v1/staff/member/{name}", withCacheControl(config.RestAPI.StaffCacheControl, endpoints.HandleStaffMember)).Methods(http.MethodGet, http.MethodHead)
+	}
+	if config.Endpoints.Player {
+		router.HandleFunc("/api/v1/player/{player}", endpoints.HandlePlayer).Methods(http.MethodGet, http.MethodHead)
+		router.HandleFunc("/api/v1/player/{player}/rank", endpoints.HandlePlayerRank).Methods(http.MethodGet, http.MethodHead)
+		router.HandleFunc("/api/v1/player/{player}/rank-position", endpoints.HandlePlayerVotePosition).Methods(http.MethodGet, http.MethodHead)
+		router.HandleFunc("/api/v1/players", endpoints.HandlePlayers).Methods(http.MethodGet, http.MethodHead)
+	}
+	if config.Endpoints.Votes && config.Endpoints.Staff {
+		router.HandleFunc("/api/v1/stats", endpoints.HandleStats).Methods(http.MethodGet, http.MethodHead)
+	}
+	if config.Endpoints.OpenAPI {
+		router.HandleFunc("/api/v1/openapi.json", endpoints.HandleOpenAPI).Methods(http.MethodGet, http.MethodHead)
+	}
+	router.HandleFunc("/api/v1/version", endpoints.HandleVersion).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/api/v1/batch", endpoints.HandleBatch).Methods(http.MethodPost)
+
+	admin := router.PathPrefix("/api/v1/admin").Subrouter()
+	admin.Use(requireAPIKey)
+	admin.HandleFunc("/cache/flush", endpoints.HandleFlushCache).Methods(http.MethodPost)
+	admin.HandleFunc("/metrics", endpoints.HandleMetrics).Methods(http.MethodGet, http.MethodHead)
+	admin.HandleFunc("/stats", endpoints.HandleAdminStats).Methods(http.MethodGet, http.MethodHead)
+
+	// Registered last, so that API routes take precedence
+	if config.RestAPI.StaticDir != "" {
+		router.PathPrefix("/").MatcherFunc(isFrontendPath).Handler(newSPAHandler(config.RestAPI.StaticDir)).Methods(http.MethodGet, http.MethodHead)
+	}
+
+	router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(handleMethodNotAllowed)
+
+	router.Use(requestIDMiddleware)
+
+	var accessLogger *zap.Logger
+	if config.RestAPI.AccessLogPath != "" {
+		accessLogFile, err := openReopenableFile(config.RestAPI.AccessLogPath)
+		if err != nil {
+			zap.L().Panic("failed to open access log", zap.String("path", config.RestAPI.AccessLogPath), zap.Error(err))
+		}
+		accessLogger = newFileLogger(accessLogFile)
+		defer accessLogger.Sync()
+
+		// Reopen on SIGHUP so that logrotate can move the file away
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := accessLogFile.Reopen(); err != nil {
+					zap.L().Error("failed to reopen access log", zap.Error(err))
+				}
+			}
+		}()
+	}
+	router.Use(accessLogMiddleware(accessLogger))
+	if config.RestAPI.RecoverPanics {
+		router.Use(recoveryMiddleware)
+	}
+	if config.RestAPI.RateLimit > 0 {
+		burst := config.RestAPI.RateLimitBurst
+		if burst < 1 {
+			burst = 1
+		}
+		router.Use(newRateLimiter(config.RestAPI.RateLimit, burst).Middleware)
+	}
+	router.Use(requestSizeLimits)
+	router.Use(monitor.Middleware)
+	router.Use(encoderMiddleware)
 
 	srv := &http.Server{
 		Addr:         config.RestAPI.ListenAddress,
@@ -106,9 +373,17 @@ func main() {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 
+	listener, err := listen(config.RestAPI.ListenAddress)
+	if err != nil {
+		zap.L().Panic("failed to listen", zap.String("address", config.RestAPI.ListenAddress), zap.Error(err))
+	}
+	if config.RestAPI.MaxConnections > 0 {
+		listener = newLimitListener(listener, config.RestAPI.MaxConnections)
+	}
+
 	exitCh := make(chan bool, 1)
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
 			zap.L().Error("failed to serve http", zap.Error(err))
 		}
 		exitCh <- true
@@ -137,3 +412,67 @@ func main() {
 		zap.L().Info("exiting")
 	}
 }
+
+// Listens on a TCP address, or on a Unix socket when address is like "unix:/run/throne-api.sock".
+// Socket file is removed when the listener gets closed
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix:")
+
+	// Remove socket left behind by an unclean exit, but nothing else that happens to be at the path
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := strconv.ParseUint(config.RestAPI.SocketMode, 8, 32)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("invalid socket mode %q: %w", config.RestAPI.SocketMode, err)
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func openDatabase(dsn string, pool databasePoolConfig) (*sql.DB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime.Duration)
+	return db, nil
+}
+
+// Normalizes configured staff group names into a set. Everyone is in the default group, so it's never staff
+func staffRankNames(groupNames []string, defaultGroup string) map[string]bool {
+	defaultGroupName := normalizeGroupName(defaultGroup)
+	rankNames := map[string]bool{}
+	for _, rankName := range groupNames {
+		if normalizeGroupName(rankName) == defaultGroupName {
+			zap.L().Warn("default group is listed in staff_group_names, ignoring it", zap.String("group", rankName))
+			continue
+		}
+		rankNames[normalizeGroupName(rankName)] = true
+	}
+	return rankNames
+}
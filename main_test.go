@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixRefusesToRemoveRegularFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "throne-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(path, []byte("important"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if listener, err := listen("unix:" + path); err == nil {
+		listener.Close()
+		t.Fatal("expected listening on a regular file to fail")
+	}
+	if content, err := ioutil.ReadFile(path); err != nil || string(content) != "important" {
+		t.Errorf("regular file was touched: %q, %v", content, err)
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.SocketMode = "0660"
+
+	dir, err := ioutil.TempDir("", "throne-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Socket file left behind by an unclean exit
+	path := filepath.Join(dir, "api.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("failed to listen over stale socket: %v", err)
+	}
+	listener.Close()
+}
+
+func TestStaffRankNamesSkipDefaultGroup(t *testing.T) {
+	cases := []struct {
+		name         string
+		groupNames   []string
+		defaultGroup string
+		expected     []string
+	}{
+		{"default group listed", []string{"admin", "default", "mod"}, "default", []string{"admin", "mod"}},
+		{"different case and spacing", []string{"Admin", " Default "}, "default", []string{"admin"}},
+		{"renamed default group", []string{"admin", "default"}, "member", []string{"admin", "default"}},
+		{"only default group", []string{"default"}, "default", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rankNames := staffRankNames(c.groupNames, c.defaultGroup)
+			if len(rankNames) != len(c.expected) {
+				t.Errorf("got %v, expected %v", rankNames, c.expected)
+			}
+			for _, name := range c.expected {
+				if !rankNames[name] {
+					t.Errorf("got %v, expected %q in it", rankNames, name)
+				}
+			}
+		})
+	}
+}
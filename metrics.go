@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+// Serves cache metrics in Prometheus text format. Meant to be scraped with the admin API key
+// as bearer token
+func (e *Endpoints) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	caches := []*responseCache{e.staffCache, e.votersCache, e.statsCache}
+
+	var buf bytes.Buffer
+	buf.WriteString("# HELP cache_hits_total Lookups served from response cache.\n")
+	buf.WriteString("# TYPE cache_hits_total counter\n")
+	for _, cache := range caches {
+		hits, _ := cache.Stats()
+		fmt.Fprintf(&buf, "cache_hits_total{endpoint=%q} %d\n", cache.name, hits)
+	}
+
+	buf.WriteString("# HELP cache_misses_total Lookups not found in response cache, not counted while caching is disabled.\n")
+	buf.WriteString("# TYPE cache_misses_total counter\n")
+	for _, cache := range caches {
+		_, misses := cache.Stats()
+		fmt.Fprintf(&buf, "cache_misses_total{endpoint=%q} %d\n", cache.name, misses)
+	}
+
+	buf.WriteString("# HELP cache_entries Unexpired entries in response cache.\n")
+	buf.WriteString("# TYPE cache_entries gauge\n")
+	for _, cache := range caches {
+		fmt.Fprintf(&buf, "cache_entries{endpoint=%q} %d\n", cache.name, cache.Len())
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,20 @@
+package main
+
+import "sort"
+
+// Returns the first configured vote milestone above votes and how many votes it takes to reach it.
+// Both are nil interfaces when milestones are not configured, so that the fields are omitted, and
+// typed nil pointers serializing as null when all milestones are already passed
+func milestoneProgress(votes int) (next interface{}, votesToNext interface{}) {
+	milestones := config.RestAPI.VoteMilestones
+	if len(milestones) == 0 {
+		return nil, nil
+	}
+
+	// Milestones are sorted at startup
+	i := sort.SearchInts(milestones, votes+1)
+	if i == len(milestones) {
+		return (*int)(nil), (*int)(nil)
+	}
+	return milestones[i], milestones[i] - votes
+}
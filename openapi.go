@@ -0,0 +1,13 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+func (e *Endpoints) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeBody(w, http.StatusOK, "application/json", openAPISpec)
+}
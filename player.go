@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Looks up players by name with a single query. Returned map is keyed by requested names,
+// players which could not be found are left out
+func (e *Endpoints) fetchPlayers(ctx context.Context, names []string) (map[string]*PlayerInfo, error) {
+	requested := map[string]string{}
+	var placeholders []string
+	var args []interface{}
+	for _, name := range names {
+		// LuckPerms stores usernames in lowercase
+		lowerName := strings.ToLower(name)
+		if _, ok := requested[lowerName]; ok {
+			continue
+		}
+		requested[lowerName] = name
+		placeholders = append(placeholders, "?")
+		args = append(args, lowerName)
+	}
+	if len(args) == 0 {
+		return map[string]*PlayerInfo{}, nil
+	}
+
+	lastSeenColumn := "null"
+	if config.Database.LastSeenTable != "" {
+		lastSeenColumn = fmt.Sprintf("(select %[3]s from %[1]s where %[2]s = p.uuid)",
+			config.Database.LastSeenTable,
+			config.Database.LastSeenUUIDColumn,
+			config.Database.LastSeenColumn)
+	}
+
+	streakColumns := [2]string{"null", "null"}
+	for i, column := range []string{config.Database.ConfettiCurrentStreakColumn, config.Database.ConfettiBestStreakColumn} {
+		if column != "" {
+			streakColumns[i] = fmt.Sprintf("(select max(%s) from %s.%s where voter_name = p.username)",
+				column,
+				config.Database.ConfettiDatabaseName,
+				config.Database.ConfettiVotesTableName)
+		}
+	}
+
+	originalUsernameColumn := "null"
+	if lookup, ok := usernameLookup(); ok {
+		originalUsernameColumn = fmt.Sprintf("(select %s from %s where %s = p.username)",
+			lookup.originalColumn,
+			lookup.table,
+			lookup.nameColumn)
+	}
+
+	rows, err := e.query(ctx, "players",
+		fmt.Sprintf("select p.username, p.uuid, p.primary_group, %[3]s, "+
+			"(select coalesce(sum(votes), 0) from %[4]s.%[5]s where voter_name = p.username), "+
+			"(select coalesce(max(last_vote_timestamp), 0) from %[4]s.%[5]s where voter_name = p.username), "+
+			"%[6]s, %[8]s, %[9]s "+
+			"from %[1]s.%[2]splayers p where p.username in (%[7]s);",
+			config.Database.LuckPermsDatabaseName,
+			config.Database.LuckPermsTablePrefix,
+			originalUsernameColumn,
+			config.Database.ConfettiDatabaseName,
+			config.Database.ConfettiVotesTableName,
+			lastSeenColumn,
+			strings.Join(placeholders, ", "),
+			streakColumns[0],
+			streakColumns[1]),
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	players := map[string]*PlayerInfo{}
+	for rows.Next() {
+		var username string
+		var originalUsername *string
+		player := &PlayerInfo{}
+		if err := rows.Scan(&username, &(player.UUID), &(player.PrimaryGroup), &originalUsername,
+			&(player.Votes), &(player.LastVoteTimestamp), &(player.LastSeen),
+			&(player.CurrentStreak), &(player.BestStreak)); err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+
+		player.Name = username
+		if originalUsername != nil {
+			player.Name = *originalUsername
+		}
+		player.UUID = normalizeUUID(player.UUID)
+		player.NextMilestone, player.VotesToNext = milestoneProgress(player.Votes)
+
+		if requestedName, ok := requested[username]; ok {
+			players[requestedName] = player
+		}
+	}
+
+	return players, rows.Err()
+}
+
+// Sets VotesBySite of given players. When votes table has no site column configured,
+// only a note about it is set
+func (e *Endpoints) fillVoteBreakdown(ctx context.Context, players map[string]*PlayerInfo) error {
+	if config.Database.ConfettiSiteColumn == "" {
+		for _, player := range players {
+			player.Note = "vote sites are not tracked"
+		}
+		return nil
+	}
+
+	byName := map[string]*PlayerInfo{}
+	var placeholders []string
+	var args []interface{}
+	for _, player := range players {
+		// Confetti stores usernames in lowercase, same as LuckPerms
+		lowerName := strings.ToLower(player.Name)
+		byName[lowerName] = player
+		player.VotesBySite = map[string]int{}
+		placeholders = append(placeholders, "?")
+		args = append(args, lowerName)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	rows, err := e.query(ctx, "votes_by_site",
+		fmt.Sprintf("select voter_name, %[3]s, coalesce(sum(votes), 0) from %[1]s.%[2]s where voter_name in (%[4]s) group by voter_name, %[3]s;",
+			config.Database.ConfettiDatabaseName,
+			config.Database.ConfettiVotesTableName,
+			config.Database.ConfettiSiteColumn,
+			strings.Join(placeholders, ", ")),
+		args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var voterName string
+	var site sql.NullString
+	var votes int
+	for rows.Next() {
+		if err := rows.Scan(&voterName, &site, &votes); err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+
+		if player, ok := byName[voterName]; ok && site.Valid {
+			player.VotesBySite[site.String] += votes
+		}
+	}
+
+	return rows.Err()
+}
+
+// Sets KnownNames of given players from configured username history table. Current name is left out
+func (e *Endpoints) fillKnownNames(ctx context.Context, players map[string]*PlayerInfo) error {
+	byUUID := map[string]*PlayerInfo{}
+	var placeholders []string
+	var args []interface{}
+	for _, player := range players {
+		byUUID[player.UUID] = player
+		placeholders = append(placeholders, "?")
+		args = append(args, player.UUID)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	rows, err := e.query(ctx, "known_names",
+		fmt.Sprintf("select %[2]s, %[3]s from %[1]s where %[2]s in (%[4]s);",
+			config.Database.BenjiAuthHistoryTable,
+			config.Database.BenjiAuthHistoryUUIDColumn,
+			config.Database.BenjiAuthHistoryNameColumn,
+			strings.Join(placeholders, ", ")),
+		args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var uuid string
+	var name string
+	for rows.Next() {
+		if err := rows.Scan(&uuid, &name); err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+
+		player, ok := byUUID[normalizeUUID(uuid)]
+		if !ok || strings.EqualFold(name, player.Name) {
+			continue
+		}
+
+		known := false
+		for _, knownName := range player.KnownNames {
+			if strings.EqualFold(knownName, name) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			player.KnownNames = append(player.KnownNames, name)
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Values of color_strategy, choosing color of prefixes with multiple colors
+const (
+	colorStrategyLast     = "last"     // Color in effect at the end of the prefix
+	colorStrategyFirst    = "first"    // First color set in the prefix
+	colorStrategyDominant = "dominant" // Color covering most of the visible text
+)
+
+var (
+	miniMessageTagRegexp = regexp.MustCompile(`<[^<>]+>`)
+	// Spigot RGB color, e.g. §x§f§f§a§a§0§0 for #FFAA00
+	spigotHexRegexp   = regexp.MustCompile(`(?i)[&§]x(?:[&§][0-9A-F]){6}`)
+	prefixTokenRegexp = regexp.MustCompile(spigotHexRegexp.String() + "|" + chatColorRegexp.String() + "|" + miniMessageTagRegexp.String())
+	hexColorRegexp    = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+	miniMessageColors = map[string]string{
+		"black":        "0",
+		"dark_blue":    "1",
+		"dark_green":   "2",
+		"dark_aqua":    "3",
+		"dark_red":     "4",
+		"dark_purple":  "5",
+		"gold":         "6",
+		"gray":         "7",
+		"grey":         "7",
+		"dark_gray":    "8",
+		"dark_grey":    "8",
+		"blue":         "9",
+		"green":        "a",
+		"aqua":         "b",
+		"red":          "c",
+		"light_purple": "d",
+		"yellow":       "e",
+		"white":        "f",
+	}
+)
+
+// Extracts title and color from a LuckPerms prefix. Legacy color codes (&c, §c), Spigot RGB
+// colors (§x§f§f§a§a§0§0) and MiniMessage tags (<red>, <#ffaa00>, <gradient:#ff0000:#00ff00>)
+// are understood. Color of multi-color prefixes is picked according to color_strategy
+func parsePrefix(prefix string) (title string, color string) {
+	prefix = normalizeEncoding(prefix)
+
+	// Track colors in order of appearance along with the amount of text they color
+	var colors []string
+	coloredLength := map[string]int{}
+	current := ""
+	textStart := 0
+	for _, loc := range prefixTokenRegexp.FindAllStringIndex(prefix, -1) {
+		coloredLength[current] += visibleLength(prefix[textStart:loc[0]])
+		textStart = loc[1]
+
+		if found := prefixTokenColor(prefix[loc[0]:loc[1]]); found != "" {
+			if _, seen := coloredLength[found]; !seen {
+				colors = append(colors, found)
+				coloredLength[found] = 0
+			}
+			current = found
+		}
+	}
+	coloredLength[current] += visibleLength(prefix[textStart:])
+
+	if len(colors) > 0 {
+		switch config.Database.ColorStrategy {
+		case colorStrategyFirst:
+			color = colors[0]
+		case colorStrategyDominant:
+			// Ties go to the earlier color
+			for _, candidate := range colors {
+				if color == "" || coloredLength[candidate] > coloredLength[color] {
+					color = candidate
+				}
+			}
+		default:
+			color = current
+		}
+	}
+
+	// Get rank title by stripping minecraft color codes and MiniMessage tags
+	title = spigotHexRegexp.ReplaceAllString(prefix, "")
+	title = chatColorRegexp.ReplaceAllString(title, "")
+	title = miniMessageTagRegexp.ReplaceAllString(title, "")
+
+	// Post process (unescape etc.)
+	title = strings.ReplaceAll(title, `\`, "")
+
+	return
+}
+
+// Returns hex color set by a prefix token, or empty string for formatting codes and other tags
+func prefixTokenColor(token string) string {
+	if strings.HasPrefix(token, "<") {
+		return miniMessageTagColor(token[1 : len(token)-1])
+	} else if spigotHexRegexp.MatchString(token) {
+		return spigotHexColor(token)
+	}
+	return chatColorsToHex[strings.ToLower(token[len(token)-1:])]
+}
+
+// Counts characters of prefix text which show up in game, ignoring whitespace and escapes
+func visibleLength(text string) int {
+	length := 0
+	for _, r := range text {
+		if r != '\\' && !unicode.IsSpace(r) {
+			length++
+		}
+	}
+	return length
+}
+
+// Some plugins store prefixes in latin1, so section sign ends up either as a lone 0xA7 byte
+// or double encoded as "Â§". Turns both into proper UTF-8
+func normalizeEncoding(prefix string) string {
+	prefix = strings.ReplaceAll(prefix, "Â§", "§")
+	if utf8.ValidString(prefix) {
+		return prefix
+	}
+
+	var normalized strings.Builder
+	for i := 0; i < len(prefix); {
+		r, size := utf8.DecodeRuneInString(prefix[i:])
+		if r == utf8.RuneError && size == 1 {
+			// Latin1 byte values map directly to code points
+			r = rune(prefix[i])
+		}
+		normalized.WriteRune(r)
+		i += size
+	}
+	return normalized.String()
+}
+
+// Reconstructs hex color from a Spigot RGB color sequence, where each hex digit follows a color code character
+func spigotHexColor(token string) string {
+	digits := strings.NewReplacer("§", "", "&", "").Replace(token)
+	// First character is the "x" marker
+	return "#" + strings.ToUpper(digits[1:])
+}
+
+// Returns hex color of a MiniMessage tag (without angle brackets), or empty string if tag does not set a color.
+// Gradients and transitions yield their start color
+func miniMessageTagColor(tag string) string {
+	args := strings.Split(tag, ":")
+	switch strings.ToLower(args[0]) {
+	case "color", "colour", "c", "gradient", "transition":
+		if len(args) > 1 {
+			return miniMessageColor(args[1])
+		}
+		return ""
+	default:
+		return miniMessageColor(args[0])
+	}
+}
+
+func miniMessageColor(value string) string {
+	if hexColorRegexp.MatchString(value) {
+		return strings.ToUpper(value)
+	}
+
+	if code, ok := miniMessageColors[strings.ToLower(value)]; ok {
+		return chatColorsToHex[code]
+	}
+
+	return ""
+}
@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+type prefixCase struct {
+	prefix string
+	title  string
+	color  string
+}
+
+func checkPrefixes(t *testing.T, cases []prefixCase) {
+	t.Helper()
+	for _, c := range cases {
+		title, color := parsePrefix(c.prefix)
+		if title != c.title || color != c.color {
+			t.Errorf("%q: got title %q and color %q, expected %q and %q", c.prefix, title, color, c.title, c.color)
+		}
+	}
+}
+
+func TestParsePrefixLegacy(t *testing.T) {
+	checkPrefixes(t, []prefixCase{
+		{"&cAdmin", "Admin", "#FF5555"},
+		{"&c&lAdmin ", "Admin ", "#FF5555"},
+		{"&8[&6Mod&8] ", "[Mod] ", "#555555"},
+		{"§9Builder", "Builder", "#5555FF"},
+		{"Helper", "Helper", ""},
+	})
+}
+
+func TestParsePrefixMiniMessage(t *testing.T) {
+	checkPrefixes(t, []prefixCase{
+		{"<gradient:#ff0000:#00ff00>Owner</gradient>", "Owner", "#FF0000"},
+		{"<#ffaa00>Mod", "Mod", "#FFAA00"},
+		{"<red><bold>Helper</bold></red>", "Helper", "#FF5555"},
+		{"<color:dark_aqua>Builder", "Builder", "#00AAAA"},
+		{"<transition:gold:red:0.5>Dev", "Dev", "#FFAA00"},
+		{"<dark_gray>[<gold>VIP<dark_gray>] ", "[VIP] ", "#555555"},
+		{"<bold>Plain</bold>", "Plain", ""},
+		{"<hover:show_text:'hi'><aqua>Staff", "Staff", "#55FFFF"},
+	})
+}
+
+func TestNormalizeEncoding(t *testing.T) {
+	cases := map[string]string{
+		"§cAdmin":    "§cAdmin",
+		"\xa7cAdmin": "§cAdmin",
+		"Â§cAdmin":   "§cAdmin",
+		// Other latin1 characters are kept too
+		"\xa7cCaf\xe9": "§cCafé",
+		"&cAdmin":      "&cAdmin",
+	}
+	for prefix, expected := range cases {
+		if normalized := normalizeEncoding(prefix); normalized != expected {
+			t.Errorf("%q: got %q, expected %q", prefix, normalized, expected)
+		}
+	}
+}
+
+func TestParsePrefixSectionSignEncodings(t *testing.T) {
+	checkPrefixes(t, []prefixCase{
+		{"§cAdmin", "Admin", "#FF5555"},
+		{"\xa7cAdmin", "Admin", "#FF5555"},
+		{"Â§cAdmin", "Admin", "#FF5555"},
+		{"\xa78[\xa76Mod\xa78]", "[Mod]", "#555555"},
+	})
+}
+
+func TestParsePrefixSpigotHex(t *testing.T) {
+	checkPrefixes(t, []prefixCase{
+		{"§x§f§f§a§a§0§0Mod", "Mod", "#FFAA00"},
+		{"&x&F&F&A&A&0&0Mod", "Mod", "#FFAA00"},
+		// Gradient as written by Spigot plugins, one color per letter, ending in gray brackets
+		{"§x§f§f§0§0§0§0O§x§f§f§5§5§0§0w§x§f§f§a§a§0§0n§x§f§f§f§f§0§0e§x§a§a§f§f§0§0r §7", "Owner ", "#AAAAAA"},
+		{"§x§f§f§0§0§0§0O§x§f§f§5§5§0§0w§x§f§f§a§a§0§0n§x§f§f§f§f§0§0e§x§a§a§f§f§0§0r", "Owner", "#AAFF00"},
+		{"\xa7x\xa7f\xa7f\xa7a\xa7a\xa70\xa70Mod", "Mod", "#FFAA00"},
+	})
+}
+
+func TestParsePrefixColorStrategy(t *testing.T) {
+	cases := []struct {
+		strategy string
+		prefixes []prefixCase
+	}{
+		{colorStrategyLast, []prefixCase{
+			{"&8[&6Moderator&8] ", "[Moderator] ", "#555555"},
+			{"&cA&9dmin", "Admin", "#5555FF"},
+			{"<red>Ow<blue>ner", "Owner", "#5555FF"},
+		}},
+		{colorStrategyFirst, []prefixCase{
+			{"&8[&6Moderator&8] ", "[Moderator] ", "#555555"},
+			{"&cA&9dmin", "Admin", "#FF5555"},
+			{"<red>Ow<blue>ner", "Owner", "#FF5555"},
+		}},
+		{colorStrategyDominant, []prefixCase{
+			{"&8[&6Moderator&8] ", "[Moderator] ", "#FFAA00"},
+			{"&cA&9dmin", "Admin", "#5555FF"},
+			// Ties go to the earlier color
+			{"<red>Ow<blue>ne", "Owne", "#FF5555"},
+		}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.strategy, func(t *testing.T) {
+			restoreConfig(t)
+			config.Database.ColorStrategy = c.strategy
+			checkPrefixes(t, c.prefixes)
+		})
+	}
+}
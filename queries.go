@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Runs a read-only query, logging it when it takes longer than slow_query_threshold
+func (e *Endpoints) query(ctx context.Context, name string, query string, args ...interface{}) (*sql.Rows, error) {
+	logQuery(ctx, name, query)
+	start := time.Now()
+	queryCtx, stop := withQueryTimeout(ctx)
+	rows, err := e.readDB.QueryContext(queryCtx, query, args...)
+	timedOut := stop()
+	logSlowQuery(ctx, name, time.Since(start), args)
+
+	if timedOut {
+		logQueryTimeout(ctx, name)
+		if err == nil {
+			// Rows are unusable after their context got canceled
+			rows.Close()
+			err = context.DeadlineExceeded
+		}
+		return nil, fmt.Errorf("query %s exceeded db_query_timeout: %w", name, err)
+	}
+	return rows, err
+}
+
+// Same as query, but for queries returning at most one row
+func (e *Endpoints) queryRow(ctx context.Context, name string, query string, args ...interface{}) *sql.Row {
+	logQuery(ctx, name, query)
+	start := time.Now()
+	queryCtx, stop := withQueryTimeout(ctx)
+	row := e.readDB.QueryRowContext(queryCtx, query, args...)
+	if stop() {
+		// Row reports the cancellation itself when scanned
+		logQueryTimeout(ctx, name)
+	}
+	logSlowQuery(ctx, name, time.Since(start), args)
+	return row
+}
+
+// Bounds running a query by db_query_timeout, separately from the handler timeout covering the whole
+// request. Returned stop function must be called once the query has returned, and tells whether it
+// timed out. Reading returned rows is only bound by ctx, as stopping leaves the query context alive
+func withQueryTimeout(ctx context.Context) (context.Context, func() bool) {
+	timeout := config.RestAPI.DBQueryTimeout.Duration
+	if timeout <= 0 {
+		return ctx, func() bool { return false }
+	}
+
+	queryCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	return queryCtx, func() bool {
+		return !timer.Stop()
+	}
+}
+
+// Tells database apart from response processing as the slow part, as both end up in a handler timeout
+func logQueryTimeout(ctx context.Context, name string) {
+	logger(ctx).Warn("database query timed out",
+		zap.String("query", name),
+		zap.Duration("dbQueryTimeout", config.RestAPI.DBQueryTimeout.Duration))
+}
+
+// Logs SQL at debug level when log_queries is enabled, handy for checking configured table names
+func logQuery(ctx context.Context, name string, query string) {
+	if config.RestAPI.LogQueries {
+		logger(ctx).Debug("running database query", zap.String("query", name), zap.String("sql", query))
+	}
+}
+
+func logSlowQuery(ctx context.Context, name string, elapsed time.Duration, args []interface{}) {
+	threshold := config.RestAPI.SlowQueryThreshold.Duration
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+
+	fields := []zap.Field{zap.String("query", name), zap.Duration("elapsed", elapsed)}
+	if config.RestAPI.SlowQueryLogArgs {
+		fields = append(fields, zap.Any("args", args))
+	} else {
+		fields = append(fields, zap.Int("args", len(args)))
+	}
+	logger(ctx).Warn("slow database query", fields...)
+}
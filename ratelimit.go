@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type rateLimiter struct {
+	limit    rate.Limit
+	burst    int
+	mu       sync.Mutex
+	visitors map[string]*visitor
+}
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	rl := &rateLimiter{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		visitors: map[string]*visitor{},
+	}
+	go rl.cleanup(time.Minute, 3*time.Minute)
+	return rl
+}
+
+func (rl *rateLimiter) getLimiter(ip string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	v, ok := rl.visitors[ip]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.visitors[ip] = v
+	}
+	v.lastSeen = time.Now()
+	return v.limiter
+}
+
+// Drops limiters of clients which have not been seen for a while, otherwise the map would grow forever
+func (rl *rateLimiter) cleanup(interval time.Duration, maxIdle time.Duration) {
+	for range time.Tick(interval) {
+		rl.mu.Lock()
+		for ip, v := range rl.visitors {
+			if time.Since(v.lastSeen) > maxIdle {
+				delete(rl.visitors, ip)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+func (rl *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservation := rl.getLimiter(clientIP(r)).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeResponse(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Parsed trusted_proxies
+var (
+	trustedProxies []*net.IPNet
+	// Whether peers connecting over a Unix socket are trusted, from "unix" in trusted_proxies
+	trustUnixPeers bool
+)
+
+// Parses CIDR ranges, bare addresses are taken as single host ranges. "unix" stands for peers
+// connecting over a Unix socket, which have no address to list
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, bool, error) {
+	var parsed []*net.IPNet
+	unix := false
+	for _, proxy := range proxies {
+		if proxy == "unix" {
+			unix = true
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, false, err
+		}
+		parsed = append(parsed, network)
+	}
+	return parsed, unix, nil
+}
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Peers connecting over a Unix socket have an empty or "@" address
+func isUnixPeer(peer string) bool {
+	return peer == "" || peer == "@"
+}
+
+// Returns address of the client. Forwarding headers are only looked at when the direct peer is a
+// trusted proxy, so clients can't spoof their address by sending the headers themselves
+func clientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+
+	if !isTrustedProxy(peer) && !(trustUnixPeers && isUnixPeer(peer)) {
+		return peer
+	}
+
+	// Each proxy appends the address it got the request from, so walk back until a hop is not a trusted proxy
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		hops := strings.Split(forwardedFor, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if i == 0 || !isTrustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	return peer
+}
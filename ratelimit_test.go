@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	savedProxies, savedUnix := trustedProxies, trustUnixPeers
+	t.Cleanup(func() {
+		trustedProxies, trustUnixPeers = savedProxies, savedUnix
+	})
+
+	var err error
+	if trustedProxies, trustUnixPeers, err = parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "unix"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		realIP       string
+		expectedIP   string
+	}{
+		{"direct client", "203.0.113.1:1234", "", "", "203.0.113.1"},
+		{"spoofed header from untrusted peer", "203.0.113.1:1234", "198.51.100.1", "198.51.100.1", "203.0.113.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"bare address proxy", "192.168.1.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"spoofed hop before untrusted one", "10.0.0.1:1234", "192.0.2.1, 198.51.100.1", "", "198.51.100.1"},
+		{"real ip from trusted proxy", "10.0.0.1:1234", "", "198.51.100.1", "198.51.100.1"},
+		{"unix socket peer", "@", "198.51.100.1", "", "198.51.100.1"},
+		{"unnamed unix socket peer", "", "198.51.100.1", "", "198.51.100.1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/votes", nil)
+			r.RemoteAddr = c.remoteAddr
+			if c.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", c.forwardedFor)
+			}
+			if c.realIP != "" {
+				r.Header.Set("X-Real-IP", c.realIP)
+			}
+
+			if ip := clientIP(r); ip != c.expectedIP {
+				t.Errorf("got %q, expected %q", ip, c.expectedIP)
+			}
+		})
+	}
+}
+
+func TestClientIPUntrustedUnixPeer(t *testing.T) {
+	savedProxies, savedUnix := trustedProxies, trustUnixPeers
+	t.Cleanup(func() {
+		trustedProxies, trustUnixPeers = savedProxies, savedUnix
+	})
+	trustedProxies, trustUnixPeers = nil, false
+
+	r := httptest.NewRequest("GET", "/api/v1/votes", nil)
+	r.RemoteAddr = "@"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if ip := clientIP(r); ip != "@" {
+		t.Errorf("got %q, expected headers of untrusted unix peer to be ignored", ip)
+	}
+}
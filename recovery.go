@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// Turns handler panics into 500 responses with the stack trace logged. http.ErrAbortHandler
+// is passed on, as it's used to deliberately abort a response
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			} else if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			logger(r.Context()).Error("handler panicked",
+				zap.Any("panic", recovered),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.ByteString("stack", debug.Stack()))
+			writeResponse(w, http.StatusInternalServerError, "internal server error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stands for a panic of a goroutine doing work for a handler
+var errWorkerPanicked = errors.New("worker panicked")
+
+// Recovers a panic of a goroutine doing work for a handler, which recovery middleware can't catch
+// as it only covers the handler goroutine itself. The panic is logged and handed to fail as an
+// error, so that the handler answers with 500 instead of the whole process crashing. Must be
+// deferred directly
+func recoverWorker(ctx context.Context, fail func(err error)) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+
+	logger(ctx).Error("request worker panicked",
+		zap.Any("panic", recovered),
+		zap.ByteString("stack", debug.Stack()))
+	fail(fmt.Errorf("%w: %v", errWorkerPanicked, recovered))
+}
+
+// Returns recoverWorker fail function sending the error to resultCh, unless it already holds a result
+func failTo(resultCh chan<- interface{}) func(err error) {
+	return func(err error) {
+		select {
+		case resultCh <- err:
+		default:
+		}
+	}
+}
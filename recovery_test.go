@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	handler := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ranks map[string]*GroupInfo
+		ranks["admin"].Title = "Admin"
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/staff", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, expected 500", w.Code)
+	}
+}
+
+func TestWorkerPanicsBecomeErrors(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.VotersTimeout = duration{time.Second}
+	config.RestAPI.StaffTimeout = duration{time.Second}
+	config.RestAPI.MaxBatchPlayers = 50
+
+	cases := []struct {
+		name    string
+		match   string
+		handler func(e *Endpoints) http.HandlerFunc
+		url     string
+	}{
+		{"voters", "order by", func(e *Endpoints) http.HandlerFunc { return e.HandleVoters }, "/api/v1/votes?limit=10"},
+		{"streamed voters", "order by", func(e *Endpoints) http.HandlerFunc { return e.HandleVoters }, "/api/v1/votes"},
+		{"votes summary", "coalesce(sum(votes)", func(e *Endpoints) http.HandlerFunc { return e.HandleVotesSummary }, "/api/v1/votes/summary"},
+		{"staff primary groups", "primary_group from", func(e *Endpoints) http.HandlerFunc { return e.HandleStaff }, "/api/v1/staff"},
+		{"staff user permissions", "user_permissions", func(e *Endpoints) http.HandlerFunc { return e.HandleStaff }, "/api/v1/staff"},
+		{"players", "players", func(e *Endpoints) http.HandlerFunc { return e.HandlePlayers }, "/api/v1/players?names=mikroskeem"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, db := newFakeEndpoints(t)
+			db.answer(c.match, nil).panics = true
+			// Anything else answers with no rows
+			db.answer("", []string{"count(*)"}, row(int64(0)))
+
+			// Unrecovered panic would crash the whole test binary
+			w := httptest.NewRecorder()
+			c.handler(e)(w, httptest.NewRequest("GET", c.url, nil))
+			if len(db.ran(c.match)) == 0 {
+				t.Fatal("panicking query was not run")
+			}
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("got status %d, expected 500", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Whether relative timestamps were asked for with "relative" query parameter
+func wantsRelative(r *http.Request) bool {
+	return r.URL.Query().Get("relative") == "true"
+}
+
+// Renders how long ago t was, e.g. "5 minutes ago". Times in the future, which can happen
+// with clocks slightly off, are "just now"
+func humanizeSince(t time.Time, now time.Time) string {
+	elapsed := now.Sub(t)
+	switch {
+	case elapsed < time.Second:
+		return "just now"
+	case elapsed < time.Minute:
+		return pluralAgo(int(elapsed/time.Second), "second")
+	case elapsed < time.Hour:
+		return pluralAgo(int(elapsed/time.Minute), "minute")
+	case elapsed < 24*time.Hour:
+		return pluralAgo(int(elapsed/time.Hour), "hour")
+	default:
+		return pluralAgo(int(elapsed/(24*time.Hour)), "day")
+	}
+}
+
+func pluralAgo(amount int, unit string) string {
+	if amount == 1 {
+		return fmt.Sprintf("1 %s ago", unit)
+	}
+	return fmt.Sprintf("%d %ss ago", amount, unit)
+}
+
+// Last seen times are in seconds, unlike vote timestamps
+func lastSeenRelative(lastSeen *uint64, now time.Time) string {
+	if lastSeen == nil {
+		return ""
+	}
+	return humanizeSince(time.Unix(int64(*lastSeen), 0), now)
+}
+
+func (v *VoterInfo) setRelative(now time.Time) {
+	if v.Timestamp != 0 {
+		v.LastVoteRelative = humanizeSince(voteTime(v.Timestamp), now)
+	}
+}
+
+func (p *PlayerInfo) setRelative(now time.Time) {
+	if p.LastVoteTimestamp != 0 {
+		p.LastVoteRelative = humanizeSince(voteTime(p.LastVoteTimestamp), now)
+	}
+	p.LastSeenRelative = lastSeenRelative(p.LastSeen, now)
+}
+
+// Returns a copy of VoterList or VotersPage with relative timestamps, as given voters may be cached
+func withRelativeVoters(voters interface{}, now time.Time) interface{} {
+	relativeList := func(list VoterList) VoterList {
+		copied := make(VoterList, len(list))
+		for i, voter := range list {
+			voter.setRelative(now)
+			copied[i] = voter
+		}
+		return copied
+	}
+
+	switch voters := voters.(type) {
+	case VoterList:
+		return relativeList(voters)
+	case VotersPage:
+		voters.Voters = relativeList(voters.Voters)
+		return voters
+	default:
+		return voters
+	}
+}
+
+// Returns a copy of group with relative last seen times of members, as given group may be cached
+func withRelativeMembers(rank *GroupInfo, now time.Time) *GroupInfo {
+	copied := *rank
+	copied.Members = make([]StaffMember, len(rank.Members))
+	for i, member := range rank.Members {
+		member.LastSeenRelative = lastSeenRelative(member.LastSeen, now)
+		copied.Members[i] = member
+	}
+	return &copied
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+type requestIDKey struct{}
+
+// Tags every request with an unique ID, which is echoed in X-Request-ID header and
+// attached to log entries made through logger()
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := uuid.New().String()
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+func requestIDFromContext(ctx context.Context) (string, bool) {
+	requestID, ok := ctx.Value(requestIDKey{}).(string)
+	return requestID, ok
+}
+
+// Returns global logger annotated with request ID from context, if present
+func logger(ctx context.Context) *zap.Logger {
+	if requestID, ok := requestIDFromContext(ctx); ok {
+		return zap.L().With(zap.String("requestID", requestID))
+	}
+	return zap.L()
+}
+
+// Returns logger for the request a response is written for, see logger()
+func responseLogger(w http.ResponseWriter) *zap.Logger {
+	if r, ok := requestFor(w); ok {
+		return logger(r.Context())
+	}
+	return zap.L()
+}
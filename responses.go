@@ -1,5 +1,12 @@
 package main
 
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
 const (
 	errorStatus = "error"
 	okStatus    = "ok"
@@ -9,6 +16,71 @@ type VoterInfo struct {
 	Username  string `json:"voter_name"`
 	Votes     int    `json:"votes"`
 	Timestamp uint64 `json:"last_vote_timestamp"`
+
+	// Consecutive voting days, omitted when streak columns are not configured
+	CurrentStreak *int `json:"current_streak,omitempty"`
+	BestStreak    *int `json:"best_streak,omitempty"`
+
+	// Only set with relative=true, e.g. "2 hours ago"
+	LastVoteRelative string `json:"last_vote_relative,omitempty"`
+
+	// Next of vote_milestones and votes missing from it. Null when all are passed, omitted when none are configured
+	NextMilestone interface{} `json:"next_milestone,omitempty"`
+	VotesToNext   interface{} `json:"votes_to_next,omitempty"`
+
+	// Omitted when avatar URLs are not configured or voter has no BenjiAuth account
+	AvatarURL string `json:"avatar_url,omitempty"`
+}
+
+type VoterList []VoterInfo
+
+func (l VoterList) CSVHeader() []string {
+	return []string{"voter_name", "votes", "last_vote_timestamp"}
+}
+
+func (l VoterList) CSVRecords() [][]string {
+	records := make([][]string, 0, len(l))
+	for _, voter := range l {
+		records = append(records, []string{
+			voter.Username,
+			strconv.Itoa(voter.Votes),
+			strconv.FormatUint(voter.Timestamp, 10),
+		})
+	}
+	return records
+}
+
+type VotersPage struct {
+	Voters     VoterList  `json:"voters"`
+	Pagination Pagination `json:"pagination"`
+}
+
+func (p VotersPage) CSVHeader() []string {
+	return p.Voters.CSVHeader()
+}
+
+func (p VotersPage) CSVRecords() [][]string {
+	return p.Voters.CSVRecords()
+}
+
+type Pagination struct {
+	Limit   int  `json:"limit"` // 0 when not limited
+	Offset  int  `json:"offset"`
+	Total   int  `json:"total"`
+	HasMore bool `json:"has_more"`
+}
+
+type VotesSummary struct {
+	TotalVotes  int    `json:"total_votes"`
+	TotalVoters int    `json:"total_voters"`
+	LastVote    uint64 `json:"last_vote"`
+}
+
+type Stats struct {
+	TotalVotes   int `json:"total_votes"`
+	TotalVoters  int `json:"total_voters"`
+	StaffGroups  int `json:"staff_groups"`  // Groups with at least one member
+	StaffMembers int `json:"staff_members"` // Distinct members across all groups
 }
 
 type StaffInfo struct {
@@ -16,13 +88,161 @@ type StaffInfo struct {
 }
 
 type GroupInfo struct {
-	Title   string   `json:"title"`
-	Color   string   `json:"color"`
-	Weight  int      `json:"weight"`
-	Members []string `json:"members"`
+	// Only set when groups are listed instead of keyed by name
+	Name string `json:"name,omitempty"`
+
+	Title   string        `json:"title"`
+	Color   string        `json:"color"`
+	Weight  int           `json:"weight"`
+	Members []StaffMember `json:"members"`
+
+	// Set when members were cut off at max_members_per_group or paged through
+	Truncated    bool `json:"truncated,omitempty"`
+	TotalMembers int  `json:"total_members,omitempty"`
+
+	// Set when title, color and weight could not be fetched in time
+	Partial bool `json:"partial,omitempty"`
+
+	// Whether weight came from "weight." node, which wins over "meta.weight." node
+	weightFromPermission bool
+	// Whether title came from "displayname." node, which wins over the prefix
+	titleFromDisplayName bool
+}
+
+type GroupMetadata struct {
+	Title  string `json:"title"`
+	Color  string `json:"color"`
+	Weight int    `json:"weight"`
+}
+
+type StaffMember struct {
+	Name     string  `json:"name"`
+	UUID     string  `json:"uuid,omitempty"`
+	LastSeen *uint64 `json:"last_seen,omitempty"`
+
+	// Only set with relative=true
+	LastSeenRelative string `json:"last_seen_relative,omitempty"`
+}
+
+// Serializes as plain name unless include_uuids is enabled or last seen table is configured
+func (m StaffMember) MarshalJSON() ([]byte, error) {
+	if !config.Database.IncludeUUIDs && config.Database.LastSeenTable == "" {
+		return json.Marshal(m.Name)
+	}
+
+	if !config.Database.IncludeUUIDs {
+		m.UUID = ""
+	}
+
+	type staffMember StaffMember
+	return json.Marshal(staffMember(m))
+}
+
+// Same as MarshalJSON, for msgpack responses
+func (m StaffMember) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if !config.Database.IncludeUUIDs && config.Database.LastSeenTable == "" {
+		return enc.EncodeString(m.Name)
+	}
+
+	if !config.Database.IncludeUUIDs {
+		m.UUID = ""
+	}
+
+	type staffMember StaffMember
+	return enc.Encode(staffMember(m))
+}
+
+type PlayerInfo struct {
+	Name              string  `json:"name"`
+	UUID              string  `json:"uuid"`
+	PrimaryGroup      string  `json:"primary_group"`
+	Votes             int     `json:"votes"`
+	LastVoteTimestamp uint64  `json:"last_vote_timestamp"`
+	LastSeen          *uint64 `json:"last_seen,omitempty"`
+
+	// Only set with relative=true, e.g. "2 hours ago"
+	LastVoteRelative string `json:"last_vote_relative,omitempty"`
+	LastSeenRelative string `json:"last_seen_relative,omitempty"`
+
+	// Consecutive voting days, omitted when streak columns are not configured or player has not voted
+	CurrentStreak *int `json:"current_streak,omitempty"`
+	BestStreak    *int `json:"best_streak,omitempty"`
+
+	// Same as in VoterInfo
+	NextMilestone interface{} `json:"next_milestone,omitempty"`
+	VotesToNext   interface{} `json:"votes_to_next,omitempty"`
+
+	// Previous usernames, omitted when username history is not configured or empty
+	KnownNames []string `json:"known_names,omitempty"`
+
+	// Only set when vote breakdown is requested
+	VotesBySite map[string]int `json:"votes_by_site,omitempty"`
+	Note        string         `json:"note,omitempty"`
+}
+
+type VotePosition struct {
+	Name     string `json:"voter_name"`
+	Position int    `json:"position"` // 1-based, tied voters share a position
+	Votes    int    `json:"votes"`
+}
+
+type RankInfo struct {
+	Group  string `json:"group"`
+	Title  string `json:"title"`
+	Color  string `json:"color"`
+	Weight int    `json:"weight"`
+}
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+type AdminStats struct {
+	UptimeSeconds int64          `json:"uptime_seconds"`
+	Goroutines    int            `json:"goroutines"`
+	Memory        MemoryStats    `json:"memory"`
+	Database      DBPoolStats    `json:"database"`
+	ReadDatabase  *DBPoolStats   `json:"read_database,omitempty"` // Only when read replica is configured
+	CacheEntries  map[string]int `json:"cache_entries"`
+}
+
+// Subset of runtime.MemStats, in bytes
+type MemoryStats struct {
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	Sys        uint64 `json:"sys"`
+	TotalAlloc uint64 `json:"total_alloc"`
+	NumGC      uint32 `json:"num_gc"`
+}
+
+// Subset of sql.DBStats
+type DBPoolStats struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMillis int64 `json:"wait_duration_ms"`
+}
+
+type CacheFlushResult struct {
+	Cleared int `json:"cleared"`
 }
 
 type StatusResponse struct {
 	Status string      `json:"status"`
 	Data   interface{} `json:"data"`
 }
+
+// Error response with envelope=false
+type RawErrorResponse struct {
+	Error interface{} `json:"error"`
+}
+
+// Envelope without data, used when empty data is omitted
+type StatusOnlyResponse struct {
+	Status string `json:"status"`
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata/golden")
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func uint64Ptr(i uint64) *uint64 {
+	return &i
+}
+
+// Public response shapes, compared against checked-in fixtures so that renamed fields or changed
+// types break the build instead of frontends. Run "go test -run TestResponseGolden . -args -update" after
+// intentional changes to the API
+func TestResponseGolden(t *testing.T) {
+	cases := []struct {
+		name          string
+		status        int
+		body          interface{}
+		includeUUIDs  bool
+		lastSeenTable string
+	}{
+		{
+			name:   "voters",
+			status: http.StatusOK,
+			body: VoterList{
+				{Username: "mikroskeem", Votes: 42, Timestamp: 1590000000},
+				{
+					Username:         "Notch",
+					Votes:            7,
+					Timestamp:        1590000000000,
+					CurrentStreak:    intPtr(3),
+					BestStreak:       intPtr(10),
+					LastVoteRelative: "2 hours ago",
+					NextMilestone:    intPtr(10),
+					VotesToNext:      intPtr(3),
+					AvatarURL:        "https://crafatar.com/avatars/069a79f4-44e9-4726-a5be-fca90e38aaf5",
+				},
+			},
+		},
+		{
+			name:   "voters_page",
+			status: http.StatusOK,
+			body: VotersPage{
+				Voters:     VoterList{{Username: "mikroskeem", Votes: 42, Timestamp: 1590000000}},
+				Pagination: Pagination{Limit: 1, Offset: 0, Total: 2, HasMore: true},
+			},
+		},
+		{
+			name:   "staff",
+			status: http.StatusOK,
+			body: StaffInfo{Groups: map[string]GroupInfo{
+				"admin": {
+					Title:   "Admin",
+					Color:   "#FF5555",
+					Weight:  100,
+					Members: []StaffMember{{Name: "mikroskeem", UUID: "a1b2"}},
+				},
+				"mod": {
+					Title:        "Mod",
+					Color:        "#55FF55",
+					Weight:       50,
+					Members:      []StaffMember{{Name: "Notch", UUID: "c3d4"}},
+					Truncated:    true,
+					TotalMembers: 3,
+					Partial:      true,
+				},
+			}},
+		},
+		{
+			name:          "staff_members_detailed",
+			status:        http.StatusOK,
+			includeUUIDs:  true,
+			lastSeenTable: "lastseen.players",
+			body: []GroupInfo{{
+				Name:   "admin",
+				Title:  "Admin",
+				Color:  "#FF5555",
+				Weight: 100,
+				Members: []StaffMember{
+					{Name: "mikroskeem", UUID: "a1b2", LastSeen: uint64Ptr(1590000000), LastSeenRelative: "1 day ago"},
+					{Name: "Notch", UUID: "c3d4"},
+				},
+			}},
+		},
+		{
+			name:   "player",
+			status: http.StatusOK,
+			body: PlayerInfo{
+				Name:              "mikroskeem",
+				UUID:              "a1b2",
+				PrimaryGroup:      "admin",
+				Votes:             42,
+				LastVoteTimestamp: 1590000000,
+				LastSeen:          uint64Ptr(1590000000),
+				KnownNames:        []string{"mikroskeem_"},
+				VotesBySite:       map[string]int{"minecraft-mp.com": 42},
+			},
+		},
+		{
+			name:   "error",
+			status: http.StatusInternalServerError,
+			body:   "database access error",
+		},
+		{
+			name:   "not_found",
+			status: http.StatusNotFound,
+			body:   "not found",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			restoreConfig(t)
+			config.RestAPI.DebugPretty = true
+			config.Database.IncludeUUIDs = c.includeUUIDs
+			config.Database.LastSeenTable = c.lastSeenTable
+
+			w := httptest.NewRecorder()
+			writeResponse(w, c.status, c.body)
+			if w.Code != c.status {
+				t.Fatalf("got status %d, expected %d", w.Code, c.status)
+			}
+
+			path := filepath.Join("testdata", "golden", c.name+".json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(path, w.Body.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			expected, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(w.Body.Bytes(), expected) {
+				t.Errorf("response differs from %s\ngot:\n%s\nexpected:\n%s", path, w.Body.Bytes(), expected)
+			}
+		})
+	}
+}
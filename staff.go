@@ -0,0 +1,658 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const staffCacheKey = "staff"
+
+const (
+	memberSortName     = "name"
+	memberSortLastSeen = "last_seen"
+)
+
+// Either scanned groups or the error which stopped the scan
+type groupsScanResult struct {
+	groups map[string]*GroupInfo
+	err    error
+}
+
+// Collects staff groups with their members, title, color and weight. Sends either
+// map[string]*GroupInfo or an error to resultCh
+func (e *Endpoints) fetchStaff(ctx context.Context, resultCh chan<- interface{}) {
+	defer recoverWorker(ctx, failTo(resultCh))
+
+	collectedRanks := map[string]*GroupInfo{}
+	primaryGroupsScanned := make(chan groupsScanResult, 1)
+	userPermissionsScanned := make(chan groupsScanResult, 1)
+
+	// Collect groups and their members from players table
+	go func() {
+		defer recoverWorker(ctx, func(err error) {
+			primaryGroupsScanned <- groupsScanResult{err: err}
+		})
+
+		rows1, err := e.query(ctx, "staff_primary_groups",
+			// TODO: let database do the work and filter out unwanted groups
+			fmt.Sprintf("select uuid, username, primary_group from %s.%splayers;",
+				config.Database.LuckPermsDatabaseName,
+				config.Database.LuckPermsTablePrefix))
+		if err != nil {
+			primaryGroupsScanned <- groupsScanResult{err: err}
+			return
+		}
+		defer rows1.Close()
+
+		collected := map[string]*GroupInfo{}
+
+		var uuid string
+		var username sql.NullString
+		var primaryGroup *string
+		for rows1.Next() {
+			if err := rows1.Scan(&uuid, &username, &primaryGroup); err != nil {
+				logger(ctx).Warn("failed to scan row", zap.Error(err))
+				continue
+			}
+
+			// Skip nil primaryGroups
+			if primaryGroup == nil {
+				continue
+			}
+			rankName := normalizeGroupName(*primaryGroup)
+
+			// Filter players out only from relevant groups
+			if _, ok := checkedRankNames[rankName]; !ok {
+				continue
+			}
+
+			if _, ok := collected[rankName]; !ok {
+				collected[rankName] = &GroupInfo{}
+			}
+
+			collected[rankName].Members = append(collected[rankName].Members, newStaffMember(uuid, username))
+		}
+
+		primaryGroupsScanned <- groupsScanResult{groups: collected}
+	}()
+
+	// Collect groups from user permissions
+	go func() {
+		defer recoverWorker(ctx, func(err error) {
+			userPermissionsScanned <- groupsScanResult{err: err}
+		})
+
+		// Group assignments scoped to other servers are left out when server context is configured
+		var contextSQL string
+		var contextArgs []interface{}
+		if config.Database.LuckPermsServerContext != "" {
+			contextSQL = " and server in ('global', ?)"
+			contextArgs = append(contextArgs, config.Database.LuckPermsServerContext)
+		}
+
+		rows2, err := e.query(ctx, "staff_user_permissions",
+			// TODO: let database do the work and filter out unwanted groups
+			fmt.Sprintf("select permission, uuid, (select username from %[1]s.%[2]splayers where "+
+				"%[1]s.%[2]splayers.uuid = %[1]s.%[2]suser_permissions.uuid) as name from "+
+				"%[1]s.%[2]suser_permissions where permission like 'group.%%'%[3]s;",
+				config.Database.LuckPermsDatabaseName,
+				config.Database.LuckPermsTablePrefix,
+				contextSQL),
+			contextArgs...)
+		if err != nil {
+			userPermissionsScanned <- groupsScanResult{err: err}
+			return
+		}
+		defer rows2.Close()
+
+		collected := map[string]*GroupInfo{}
+
+		var permissionNode *string
+		var uuid string
+		var username sql.NullString
+		for rows2.Next() {
+			if err := rows2.Scan(&permissionNode, &uuid, &username); err != nil {
+				logger(ctx).Warn("failed to scan row", zap.Error(err))
+				continue
+			}
+
+			// Skip nil permission nodes
+			if permissionNode == nil {
+				continue
+			}
+
+			split := strings.Split(*permissionNode, ".")
+			if len(split) != 2 || split[1] == "" {
+				logger(ctx).Warn("unable to parse group permission node", zap.String("node", *permissionNode))
+				continue
+			}
+			rankName := normalizeGroupName(split[1])
+
+			// Filter players out only from relevant groups
+			if _, ok := checkedRankNames[rankName]; !ok {
+				continue
+			}
+
+			if _, ok := collected[rankName]; !ok {
+				collected[rankName] = &GroupInfo{}
+			}
+
+			collected[rankName].Members = append(collected[rankName].Members, newStaffMember(uuid, username))
+		}
+
+		userPermissionsScanned <- groupsScanResult{groups: collected}
+	}()
+
+	// Wait for both scans before checking errors, so neither goroutine is left behind
+	primaryGroups := <-primaryGroupsScanned
+	userPermissions := <-userPermissionsScanned
+	if primaryGroups.err != nil {
+		resultCh <- primaryGroups.err
+		return
+	}
+	if userPermissions.err != nil {
+		resultCh <- userPermissions.err
+		return
+	}
+
+	for k, v := range primaryGroups.groups {
+		collectedRanks[k] = v
+	}
+
+	// Merge groups from user permissions
+	for rankName, collectedRank := range userPermissions.groups {
+		if rank, ok := collectedRanks[rankName]; ok {
+			existingMembers := map[string]bool{}
+			for _, member := range rank.Members {
+				existingMembers[member.UUID] = true
+			}
+
+			for _, member := range collectedRank.Members {
+				if _, ok := existingMembers[member.UUID]; !ok {
+					rank.Members = append(rank.Members, member)
+				}
+			}
+		} else {
+			collectedRanks[rankName] = collectedRank
+		}
+	}
+
+	if err := e.resolveUsernames(ctx, collectedRanks); err != nil {
+		if config.Database.StrictUsernames {
+			resultCh <- err
+			return
+		}
+		logger(ctx).Warn("failed to resolve original usernames, using LuckPerms usernames",
+			zap.String("usernameSource", config.Database.UsernameSource), zap.Error(err))
+	}
+
+	if config.Database.LastSeenTable != "" {
+		if err := e.fillLastSeen(ctx, collectedRanks); err != nil {
+			logger(ctx).Warn("failed to fetch last seen times", zap.Error(err))
+		}
+	}
+
+	// Sort group members
+	for _, rank := range collectedRanks {
+		sortMembers(rank.Members)
+	}
+
+	// Nothing to look up titles and colors for
+	if len(collectedRanks) == 0 {
+		resultCh <- collectedRanks
+		return
+	}
+
+	// Query group title and color. Stop short of the deadline, so that members can still be sent
+	// without titles and colors instead of timing out altogether
+	nodesCtx, cancelNodes := withPartialMargin(ctx)
+	defer cancelNodes()
+	if err := e.fetchGroupNodes(nodesCtx, collectedRanks); err != nil {
+		if nodesCtx.Err() == nil || ctx.Err() != nil {
+			resultCh <- err
+			return
+		}
+
+		logger(ctx).Warn("ran out of time for group titles and colors, sending partial staff info")
+		for _, rank := range collectedRanks {
+			rank.Partial = true
+		}
+	}
+
+	for rankName, rank := range collectedRanks {
+		applyRankFallback(ctx, rankName, rank)
+	}
+
+	if config.Database.SingleGroupPerMember {
+		keepHighestGroupOnly(collectedRanks)
+	}
+
+	resultCh <- collectedRanks
+}
+
+// Populates staff cache so that the first request does not have to wait for the database
+func (e *Endpoints) warmupStaffCache() {
+	ctx, cancel := context.WithTimeout(context.Background(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	start := time.Now()
+	go e.fetchStaff(ctx, resultCh)
+
+	select {
+	case result := <-resultCh:
+		if err, ok := result.(error); ok {
+			zap.L().Warn("staff cache warmup failed", zap.Error(err))
+		} else if isPartialStaff(result.(map[string]*GroupInfo)) {
+			zap.L().Warn("staff cache warmup got only partial staff info, not caching it")
+		} else {
+			e.staffCache.Set(staffCacheKey, result)
+			zap.L().Info("staff cache warmed up", zap.Duration("took", time.Since(start)))
+		}
+	case <-ctx.Done():
+		zap.L().Warn("timed out while warming up staff cache")
+	}
+}
+
+// Derives a context ending partial_response_margin before ctx does. Without margin or deadline
+// ctx is used as is
+func withPartialMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if margin := config.RestAPI.PartialResponseMargin.Duration; ok && margin > 0 {
+		return context.WithDeadline(ctx, deadline.Add(-margin))
+	}
+	return context.WithCancel(ctx)
+}
+
+// Partial staff info lacks titles, colors and weights, so it's not worth caching
+func isPartialStaff(ranks map[string]*GroupInfo) bool {
+	for _, rank := range ranks {
+		if rank.Partial {
+			return true
+		}
+	}
+	return false
+}
+
+// Warns about configured staff groups which do not exist in LuckPerms, as they can never have members
+func (e *Endpoints) checkStaffGroupsExist() {
+	if len(checkedRankNames) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+
+	rows, err := e.query(ctx, "groups",
+		fmt.Sprintf("select name from %s.%sgroups;",
+			config.Database.LuckPermsDatabaseName,
+			config.Database.LuckPermsTablePrefix))
+	if err != nil {
+		zap.L().Warn("failed to check configured staff groups", zap.Error(err))
+		return
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	var groupName string
+	for rows.Next() {
+		if err := rows.Scan(&groupName); err != nil {
+			zap.L().Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+		existing[normalizeGroupName(groupName)] = true
+	}
+	if err := rows.Err(); err != nil {
+		zap.L().Warn("failed to check configured staff groups", zap.Error(err))
+		return
+	}
+
+	for rankName := range checkedRankNames {
+		if !existing[rankName] {
+			zap.L().Warn("configured staff group does not exist in LuckPerms", zap.String("group", rankName))
+		}
+	}
+}
+
+// Fills title, color and weight of given groups from their prefix, display name and weight nodes
+func (e *Endpoints) fetchGroupNodes(ctx context.Context, ranks map[string]*GroupInfo) error {
+	var placeholders []string
+	var groupNames []interface{}
+	for rankName := range ranks {
+		placeholders = append(placeholders, "?")
+		groupNames = append(groupNames, rankName)
+	}
+
+	rows, err := e.query(ctx, "group_nodes",
+		fmt.Sprintf(
+			"select name, permission from %s.%sgroup_permissions where name in (%s) and "+
+				"(permission like 'prefix.%%' or permission like 'weight.%%' or permission like 'meta.weight.%%' or "+
+				"permission like 'displayname.%%');",
+			config.Database.LuckPermsDatabaseName,
+			config.Database.LuckPermsTablePrefix,
+			strings.Join(placeholders, ", ")),
+		groupNames...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var groupName string
+	var permissionNode string
+	for rows.Next() {
+		if err := rows.Scan(&groupName, &permissionNode); err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+
+		if rank, ok := ranks[normalizeGroupName(groupName)]; ok {
+			applyGroupNode(ctx, groupName, rank, permissionNode)
+		} else {
+			logger(ctx).Error("got permission node for unknown group", zap.String("node", permissionNode), zap.String("groupName", groupName))
+		}
+	}
+
+	return rows.Err()
+}
+
+// Members unknown to LuckPerms players table are named by their UUID
+func newStaffMember(uuid string, username sql.NullString) StaffMember {
+	member := StaffMember{
+		Name: username.String,
+		UUID: normalizeUUID(uuid),
+	}
+	if !username.Valid {
+		member.Name = member.UUID
+	}
+	return member
+}
+
+// Replaces LuckPerms usernames of members with their original casing from username_source.
+// Members without an account there keep their LuckPerms username
+func (e *Endpoints) resolveUsernames(ctx context.Context, ranks map[string]*GroupInfo) error {
+	lookup, ok := usernameLookup()
+	if !ok {
+		return nil
+	}
+
+	var placeholders []string
+	var usernames []interface{}
+	seen := map[string]bool{}
+	for _, rank := range ranks {
+		for _, member := range rank.Members {
+			if !seen[member.Name] {
+				seen[member.Name] = true
+				placeholders = append(placeholders, "?")
+				usernames = append(usernames, member.Name)
+			}
+		}
+	}
+
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	rows, err := e.query(ctx, config.Database.UsernameSource+"_usernames",
+		fmt.Sprintf("select %s, %s from %s where %s in (%s);",
+			lookup.nameColumn,
+			lookup.originalColumn,
+			lookup.table,
+			lookup.nameColumn,
+			strings.Join(placeholders, ", ")),
+		usernames...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	originalNames := map[string]string{}
+	var username string
+	var originalUsername sql.NullString
+	for rows.Next() {
+		if err := rows.Scan(&username, &originalUsername); err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+
+		if originalUsername.Valid {
+			originalNames[username] = originalUsername.String
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rank := range ranks {
+		for i, member := range rank.Members {
+			if name, ok := originalNames[member.Name]; ok {
+				rank.Members[i].Name = name
+			}
+		}
+	}
+
+	return nil
+}
+
+// Sets LastSeen of every member from the configured last seen table
+func (e *Endpoints) fillLastSeen(ctx context.Context, ranks map[string]*GroupInfo) error {
+	var placeholders []string
+	var uuids []interface{}
+	for _, rank := range ranks {
+		for _, member := range rank.Members {
+			placeholders = append(placeholders, "?")
+			uuids = append(uuids, member.UUID)
+		}
+	}
+	if len(uuids) == 0 {
+		return nil
+	}
+
+	rows, err := e.query(ctx, "last_seen",
+		fmt.Sprintf("select %[2]s, %[3]s from %[1]s where %[2]s in (%[4]s);",
+			config.Database.LastSeenTable,
+			config.Database.LastSeenUUIDColumn,
+			config.Database.LastSeenColumn,
+			strings.Join(placeholders, ", ")),
+		uuids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	lastSeen := map[string]uint64{}
+	var uuid string
+	var timestamp *uint64
+	for rows.Next() {
+		if err := rows.Scan(&uuid, &timestamp); err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+		if timestamp != nil {
+			lastSeen[normalizeUUID(uuid)] = *timestamp
+		}
+	}
+
+	for _, rank := range ranks {
+		for i := range rank.Members {
+			if timestamp, ok := lastSeen[rank.Members[i].UUID]; ok {
+				timestamp := timestamp
+				rank.Members[i].LastSeen = &timestamp
+			}
+		}
+	}
+
+	return rows.Err()
+}
+
+// Sorts members according to member_sort, falling back to name
+func sortMembers(members []StaffMember) {
+	sort.SliceStable(members, func(i, j int) bool {
+		if config.Database.MemberSort == memberSortLastSeen {
+			// Most recently seen first, members without last seen time last
+			a, b := members[i].LastSeen, members[j].LastSeen
+			if a != nil && b != nil && *a != *b {
+				return *a > *b
+			} else if (a == nil) != (b == nil) {
+				return a != nil
+			}
+		}
+		return members[i].Name < members[j].Name
+	})
+}
+
+// Applies "weight.<weight>", "meta.weight.<weight>", "prefix.<priority>.<prefix>" or "displayname.<name>" permission
+// node to the group. Weight permission node takes precedence over meta node, and display name over prefix for the title.
+// Malformed nodes are logged and skipped
+func applyGroupNode(ctx context.Context, groupName string, rank *GroupInfo, permissionNode string) {
+	split := strings.Split(permissionNode, ".")
+	if len(split) < 2 || split[1] == "" {
+		logger(ctx).Warn("skipping malformed group permission node", zap.String("rankName", groupName), zap.String("node", permissionNode))
+		return
+	}
+
+	switch split[0] {
+	case "displayname":
+		// Display name may contain dots itself
+		if title, _ := parsePrefix(strings.TrimPrefix(permissionNode, "displayname.")); title != "" {
+			rank.Title = title
+			rank.titleFromDisplayName = true
+		}
+	case "weight":
+		if len(split) != 2 {
+			logger(ctx).Warn("skipping malformed group weight node", zap.String("rankName", groupName), zap.String("node", permissionNode))
+			return
+		}
+		if num, err := strconv.Atoi(split[1]); err == nil {
+			rank.Weight = num
+			rank.weightFromPermission = true
+		}
+	case "meta":
+		if len(split) == 3 && split[1] == "weight" && !rank.weightFromPermission {
+			if num, err := strconv.Atoi(split[2]); err == nil {
+				rank.Weight = num
+			}
+		}
+	case "prefix":
+		var minecraftPrefix string
+		switch len(split) {
+		case 2:
+			minecraftPrefix = split[1]
+		case 3:
+			minecraftPrefix = split[2]
+		default:
+			logger(ctx).Warn("could not get rank prefix", zap.String("rankName", groupName), zap.String("node", permissionNode))
+			return
+		}
+
+		title, color := parsePrefix(minecraftPrefix)
+		if !rank.titleFromDisplayName {
+			rank.Title = title
+		}
+		rank.Color = color
+	}
+}
+
+// Groups already warned about lacking a prefix. Uncached staff requests would otherwise repeat
+// the warning for every request
+var (
+	noPrefixWarnedMu sync.Mutex
+	noPrefixWarned   = map[string]bool{}
+)
+
+// Falls back to something presentable for groups without prefix
+func applyRankFallback(ctx context.Context, rankName string, rank *GroupInfo) {
+	if rank.Title == "" {
+		noPrefixWarnedMu.Lock()
+		warned := noPrefixWarned[rankName]
+		noPrefixWarned[rankName] = true
+		noPrefixWarnedMu.Unlock()
+		if !warned {
+			logger(ctx).Warn("group has no prefix", zap.String("groupName", rankName))
+		}
+		rank.Title = humanizeRankName(rankName)
+	}
+	if rank.Color == "" {
+		rank.Color = config.Database.DefaultRankColor
+	}
+}
+
+// Keeps each member only in their highest weight group. Ties are broken by group name
+func keepHighestGroupOnly(ranks map[string]*GroupInfo) {
+	highestGroup := map[string]string{}
+	for rankName, rank := range ranks {
+		for _, member := range rank.Members {
+			current, ok := highestGroup[member.UUID]
+			if !ok || rank.Weight > ranks[current].Weight ||
+				(rank.Weight == ranks[current].Weight && rankName < current) {
+				highestGroup[member.UUID] = rankName
+			}
+		}
+	}
+
+	for rankName, rank := range ranks {
+		members := rank.Members[:0]
+		for _, member := range rank.Members {
+			if highestGroup[member.UUID] == rankName {
+				members = append(members, member)
+			}
+		}
+		rank.Members = members
+
+		if len(rank.Members) == 0 {
+			delete(ranks, rankName)
+		}
+	}
+}
+
+// LuckPerms group names are lowercase, but configuration might not be
+func normalizeGroupName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Turns UUID into dashed lowercase form
+func normalizeUUID(uuid string) string {
+	uuid = strings.ToLower(strings.ReplaceAll(uuid, "-", ""))
+	if len(uuid) != 32 {
+		return uuid
+	}
+	return uuid[0:8] + "-" + uuid[8:12] + "-" + uuid[12:16] + "-" + uuid[16:20] + "-" + uuid[20:32]
+}
+
+// Returns public name of a rank as configured in rank_aliases
+func rankDisplayName(rankName string) string {
+	if alias, ok := config.RankAliases[rankName]; ok {
+		return alias
+	}
+	return rankName
+}
+
+// Returns LuckPerms group name of a rank name from the API, which is its alias when it has one.
+// Unaliased names are taken as group names, as are aliased ones for older clients
+func resolveRankName(name string) string {
+	normalized := normalizeGroupName(name)
+	for rankName, alias := range config.RankAliases {
+		if normalizeGroupName(alias) == normalized {
+			return rankName
+		}
+	}
+	return normalized
+}
+
+// Turns rank name like "senior_mod" into "Senior Mod"
+func humanizeRankName(rankName string) string {
+	words := strings.FieldsFunc(rankName, func(r rune) bool {
+		return r == '_' || r == '-' || r == ' '
+	})
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Canned answers for the staff queries, rows are in the column order of the queries
+type staffFixture struct {
+	players     [][]driver.Value // uuid, username, primary_group
+	permissions [][]driver.Value // permission, uuid, name
+	usernames   [][]driver.Value // username, original_username
+	nodes       [][]driver.Value // name, permission
+}
+
+func (f staffFixture) answer(db *fakeDB) {
+	db.answer("primary_group from", []string{"uuid", "username", "primary_group"}, f.players...)
+	db.answer("user_permissions", []string{"permission", "uuid", "name"}, f.permissions...)
+	db.answer("original_username from", []string{"username", "original_username"}, f.usernames...)
+	db.answer("group_permissions", []string{"name", "permission"}, f.nodes...)
+}
+
+// Sets up configuration used by staff tests, with given staff groups
+func setupStaffTest(t *testing.T, rankNames ...string) {
+	restoreConfig(t)
+	setStaffGroups(t, rankNames...)
+	config.RestAPI.StaffTimeout = duration{time.Second}
+	config.Database.LuckPermsDatabaseName = "luckperms"
+	config.Database.LuckPermsTablePrefix = "luckperms_"
+}
+
+// Runs fetchStaff with the staff timeout, as handlers do
+func fetchTestStaff(t *testing.T, e *Endpoints) (map[string]*GroupInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+
+	resultCh := make(chan interface{}, 1)
+	e.fetchStaff(ctx, resultCh)
+	result := <-resultCh
+	if err, ok := result.(error); ok {
+		return nil, err
+	}
+	return result.(map[string]*GroupInfo), nil
+}
+
+func staffGroupRequest(group string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/v1/staff/"+group, nil)
+	return mux.SetURLVars(r, map[string]string{"group": group})
+}
+
+func TestResolveRankName(t *testing.T) {
+	restoreConfig(t)
+	config.RankAliases = map[string]string{"srmod": "senior_moderator"}
+
+	cases := map[string]string{
+		"senior_moderator":  "srmod",
+		"Senior_Moderator ": "srmod",
+		"srmod":             "srmod",
+		"Admin":             "admin",
+	}
+	for name, expected := range cases {
+		if rankName := resolveRankName(name); rankName != expected {
+			t.Errorf("%q: got %q, expected %q", name, rankName, expected)
+		}
+	}
+}
+
+func TestStaffGroupByAlias(t *testing.T) {
+	setupStaffTest(t, "srmod")
+	config.RankAliases = map[string]string{"srmod": "senior_moderator"}
+
+	e, db := newFakeEndpoints(t)
+	staffFixture{
+		players: [][]driver.Value{row("a1b2", "mikroskeem", "srmod")},
+		nodes:   [][]driver.Value{row("srmod", "prefix.100.&cSrMod")},
+	}.answer(db)
+
+	for _, group := range []string{"senior_moderator", "srmod"} {
+		w := httptest.NewRecorder()
+		e.HandleStaffGroup(w, staffGroupRequest(group))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, expected 200", group, w.Code)
+		}
+
+		var response struct {
+			Data struct {
+				Title string `json:"title"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Data.Title != "SrMod" {
+			t.Errorf("%s: got title %q, expected SrMod", group, response.Data.Title)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	e.HandleStaffGroup(w, staffGroupRequest("moderator"))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for unknown group, expected 404", w.Code)
+	}
+}
+
+func TestHumanizeRankName(t *testing.T) {
+	cases := map[string]string{
+		"admin":       "Admin",
+		"senior_mod":  "Senior Mod",
+		"trial-build": "Trial Build",
+		"a__b":        "A B",
+		"":            "",
+	}
+	for rankName, expected := range cases {
+		if title := humanizeRankName(rankName); title != expected {
+			t.Errorf("%q: got %q, expected %q", rankName, title, expected)
+		}
+	}
+}
+
+func TestMissingPrefixIsWarnedOnce(t *testing.T) {
+	logs := observeLogs(t)
+	// Earlier runs with -count may have warned already
+	noPrefixWarnedMu.Lock()
+	delete(noPrefixWarned, "prefixless_a")
+	delete(noPrefixWarned, "prefixless_b")
+	noPrefixWarnedMu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		applyRankFallback(context.Background(), "prefixless_a", &GroupInfo{})
+		applyRankFallback(context.Background(), "prefixless_b", &GroupInfo{})
+	}
+	applyRankFallback(context.Background(), "prefixed", &GroupInfo{Title: "Prefixed"})
+
+	warnings := logs.FilterMessage("group has no prefix")
+	if warnings.Len() != 2 {
+		t.Errorf("got %d warnings, expected one per group without prefix", warnings.Len())
+	}
+}
+
+func TestGroupWithoutNodesGetsFallback(t *testing.T) {
+	setupStaffTest(t, "senior_mod", "admin")
+	config.Database.DefaultRankColor = "#AAAAAA"
+
+	e, db := newFakeEndpoints(t)
+	staffFixture{
+		players: [][]driver.Value{
+			row("a1b2", "mikroskeem", "senior_mod"),
+			row("c3d4", "notch", "admin"),
+		},
+		nodes: [][]driver.Value{row("admin", "prefix.100.&cAdmin"), row("admin", "weight.100")},
+	}.answer(db)
+
+	ranks, err := fetchTestStaff(t, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rank := ranks["senior_mod"]
+	if rank == nil || len(rank.Members) != 1 {
+		t.Fatalf("got %+v, expected senior_mod with its member", rank)
+	}
+	if rank.Title != "Senior Mod" || rank.Color != "#AAAAAA" || rank.Weight != 0 {
+		t.Errorf("got title %q, color %q and weight %d, expected fallbacks", rank.Title, rank.Color, rank.Weight)
+	}
+
+	if admin := ranks["admin"]; admin.Title != "Admin" || admin.Color != "#FF5555" || admin.Weight != 100 {
+		t.Errorf("got %+v for group with nodes", admin)
+	}
+}
+
+func TestStaffSubqueriesFailingDoNotLeak(t *testing.T) {
+	setupStaffTest(t, "admin")
+
+	e, db := newFakeEndpoints(t)
+	primaryErr := errors.New("primary groups failed")
+	db.fail("primary_group from", primaryErr)
+	db.fail("user_permissions", errors.New("user permissions failed"))
+
+	// Let database/sql start its own goroutines before counting
+	if _, err := fetchTestStaff(t, e); err == nil {
+		t.Fatal("expected an error")
+	}
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		// Primary groups error wins, whichever query fails first
+		if _, err := fetchTestStaff(t, e); !errors.Is(err, primaryErr) {
+			t.Fatalf("got error %v, expected %v", err, primaryErr)
+		}
+	}
+
+	goroutines := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); goroutines > baseline && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		goroutines = runtime.NumGoroutine()
+	}
+	if goroutines > baseline {
+		t.Errorf("%d goroutines left behind", goroutines-baseline)
+	}
+}
+
+func TestStaffSingleSubqueryFailing(t *testing.T) {
+	setupStaffTest(t, "admin")
+
+	for _, failing := range []string{"primary_group from", "user_permissions"} {
+		e, db := newFakeEndpoints(t)
+		queryErr := errors.New("query failed")
+		db.fail(failing, queryErr)
+		staffFixture{players: [][]driver.Value{row("a1b2", "mikroskeem", "admin")}}.answer(db)
+
+		if _, err := fetchTestStaff(t, e); !errors.Is(err, queryErr) {
+			t.Errorf("%s: got error %v, expected %v", failing, err, queryErr)
+		}
+	}
+}
+
+func TestApplyGroupNodeWeight(t *testing.T) {
+	cases := []struct {
+		name   string
+		nodes  []string
+		weight int
+	}{
+		{"permission node", []string{"weight.100"}, 100},
+		{"meta node", []string{"meta.weight.50"}, 50},
+		{"permission node before meta node", []string{"weight.100", "meta.weight.50"}, 100},
+		{"permission node after meta node", []string{"meta.weight.50", "weight.100"}, 100},
+		{"negative weight", []string{"weight.-5"}, -5},
+		{"not a number", []string{"weight.heavy", "meta.weight.abc"}, 0},
+		{"other meta node", []string{"meta.suffix.50"}, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rank := &GroupInfo{}
+			for _, node := range c.nodes {
+				applyGroupNode(context.Background(), "admin", rank, node)
+			}
+			if rank.Weight != c.weight {
+				t.Errorf("got weight %d, expected %d", rank.Weight, c.weight)
+			}
+		})
+	}
+}
+
+func TestApplyGroupNodeDisplayName(t *testing.T) {
+	cases := []struct {
+		name  string
+		nodes []string
+		title string
+		color string
+	}{
+		{"display name only", []string{"displayname.Administrator"}, "Administrator", ""},
+		{"display name before prefix", []string{"displayname.Administrator", "prefix.100.&cAdmin"}, "Administrator", "#FF5555"},
+		{"display name after prefix", []string{"prefix.100.&cAdmin", "displayname.Administrator"}, "Administrator", "#FF5555"},
+		{"display name with dots", []string{"displayname.Sr. Admin"}, "Sr. Admin", ""},
+		{"colored display name", []string{"displayname.&6Owner"}, "Owner", ""},
+		{"prefix without display name", []string{"prefix.100.&cAdmin"}, "Admin", "#FF5555"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rank := &GroupInfo{}
+			for _, node := range c.nodes {
+				applyGroupNode(context.Background(), "admin", rank, node)
+			}
+			if rank.Title != c.title || rank.Color != c.color {
+				t.Errorf("got title %q and color %q, expected %q and %q", rank.Title, rank.Color, c.title, c.color)
+			}
+		})
+	}
+}
+
+func TestNoStaffSkipsGroupNodesQuery(t *testing.T) {
+	setupStaffTest(t, "admin")
+
+	e, db := newFakeEndpoints(t)
+	staffFixture{
+		// Only players outside of staff groups
+		players: [][]driver.Value{row("a1b2", "mikroskeem", "default")},
+	}.answer(db)
+
+	w := httptest.NewRecorder()
+	e.HandleStaff(w, httptest.NewRequest("GET", "/api/v1/staff", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected 200", w.Code)
+	}
+	if body := w.Body.String(); body != `{"status":"ok","data":{}}`+"\n" {
+		t.Errorf("got %s, expected empty staff", body)
+	}
+
+	if queries := db.ran("group_permissions"); len(queries) != 0 {
+		t.Errorf("group nodes were queried without staff groups: %s", queries[0].sql)
+	}
+}
+
+func TestStaffMembersMissingFromBenjiAuth(t *testing.T) {
+	setupStaffTest(t, "admin")
+
+	e, db := newFakeEndpoints(t)
+	staffFixture{
+		players: [][]driver.Value{
+			row("a1b2", "mikroskeem", "admin"),
+			row("c3d4", "notch", "admin"),
+			row("e5f6", "jeb_", "admin"),
+		},
+		// Assigned through a permission, but unknown to LuckPerms players table
+		permissions: [][]driver.Value{row("group.admin", "0123456789abcdef0123456789abcdef", nil)},
+		usernames: [][]driver.Value{
+			row("mikroskeem", "mikroskeeM"),
+			row("jeb_", nil),
+		},
+	}.answer(db)
+
+	ranks, err := fetchTestStaff(t, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, member := range ranks["admin"].Members {
+		names = append(names, member.Name)
+	}
+	expected := []string{"01234567-89ab-cdef-0123-456789abcdef", "jeb_", "mikroskeeM", "notch"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("got members %v, expected %v", names, expected)
+	}
+}
+
+func TestSlowGroupNodesGivePartialStaff(t *testing.T) {
+	setupStaffTest(t, "admin")
+	config.RestAPI.StaffTimeout = duration{200 * time.Millisecond}
+	config.RestAPI.PartialResponseMargin = duration{100 * time.Millisecond}
+
+	e, db := newFakeEndpoints(t)
+	db.answer("group_permissions", []string{"name", "permission"}).delay = time.Second
+	staffFixture{players: [][]driver.Value{row("a1b2", "mikroskeem", "admin")}}.answer(db)
+
+	ranks, err := fetchTestStaff(t, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rank := ranks["admin"]
+	if !rank.Partial {
+		t.Error("staff info is not marked partial")
+	}
+	if len(rank.Members) != 1 || rank.Members[0].Name != "mikroskeem" {
+		t.Errorf("got members %v, expected mikroskeem", rank.Members)
+	}
+	if !isPartialStaff(ranks) {
+		t.Error("partial staff info would be cached")
+	}
+}
+
+func TestStaffServerContext(t *testing.T) {
+	cases := []struct {
+		name          string
+		serverContext string
+		filtered      bool
+	}{
+		{"without server context", "", false},
+		{"with server context", "survival", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupStaffTest(t, "admin")
+			config.Database.LuckPermsServerContext = c.serverContext
+
+			e, db := newFakeEndpoints(t)
+			staffFixture{permissions: [][]driver.Value{row("group.admin", "a1b2", "mikroskeem")}}.answer(db)
+			if _, err := fetchTestStaff(t, e); err != nil {
+				t.Fatal(err)
+			}
+
+			queries := db.ran("user_permissions where")
+			if len(queries) != 1 {
+				t.Fatalf("user permissions were queried %d times, expected once", len(queries))
+			}
+			query := queries[0]
+			if filtered := strings.Contains(query.sql, "server in ('global', ?)"); filtered != c.filtered {
+				t.Errorf("server filter present: %t, expected %t: %s", filtered, c.filtered, query.sql)
+			}
+			if c.filtered && (len(query.args) != 1 || query.args[0] != c.serverContext) {
+				t.Errorf("got args %v, expected [%s]", query.args, c.serverContext)
+			}
+			if !c.filtered && len(query.args) != 0 {
+				t.Errorf("got args %v, expected none", query.args)
+			}
+		})
+	}
+}
+
+func TestDefaultGroupPlayersAreNotStaff(t *testing.T) {
+	setupStaffTest(t)
+	checkedRankNames = staffRankNames([]string{"admin", "default"}, "default")
+
+	e, db := newFakeEndpoints(t)
+	staffFixture{
+		players: [][]driver.Value{
+			row("a1b2", "mikroskeem", "admin"),
+			row("c3d4", "notch", "default"),
+		},
+		permissions: [][]driver.Value{row("group.default", "e5f6", "jeb_")},
+	}.answer(db)
+
+	ranks, err := fetchTestStaff(t, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ranks["default"]; ok {
+		t.Error("default group ended up in staff")
+	}
+	if len(ranks["admin"].Members) != 1 {
+		t.Errorf("got admin members %v, expected only mikroskeem", ranks["admin"].Members)
+	}
+}
+
+func TestStaffUsernameSources(t *testing.T) {
+	cases := []struct {
+		source  string
+		queried string
+		name    string
+	}{
+		{usernameSourceBenjiAuth, "from benjiauth.users where username in", "mikroskeeM"},
+		{usernameSourceAuthMe, "from authme.authme where username in", "MikroSkeem"},
+		{usernameSourceLuckPerms, "", "mikroskeem"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.source, func(t *testing.T) {
+			setupStaffTest(t, "admin")
+			config.Database.UsernameSource = c.source
+			config.Database.BenjiAuthDatabaseName = "benjiauth"
+			config.Database.BenjiAuthUsersTableName = "users"
+			config.Database.AuthMeDatabaseName = "authme"
+			config.Database.AuthMeTableName = "authme"
+			config.Database.AuthMeNameColumn = "username"
+			config.Database.AuthMeRealNameColumn = "realname"
+
+			e, db := newFakeEndpoints(t)
+			db.answer("realname from", []string{"username", "realname"}, row("mikroskeem", "MikroSkeem"))
+			staffFixture{
+				players:   [][]driver.Value{row("a1b2", "mikroskeem", "admin")},
+				usernames: [][]driver.Value{row("mikroskeem", "mikroskeeM")},
+			}.answer(db)
+
+			ranks, err := fetchTestStaff(t, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name := ranks["admin"].Members[0].Name; name != c.name {
+				t.Errorf("got name %q, expected %q", name, c.name)
+			}
+
+			lookups := len(db.ran("realname from")) + len(db.ran("original_username from"))
+			if c.queried == "" && lookups != 0 {
+				t.Errorf("usernames were looked up %d times, expected none", lookups)
+			}
+			if c.queried != "" && (lookups != 1 || len(db.ran(c.queried)) != 1) {
+				t.Errorf("expected a single username lookup containing %q", c.queried)
+			}
+		})
+	}
+}
+
+func TestApplyGroupNodeSkipsMalformed(t *testing.T) {
+	nodes := []string{"weight", "weight.", "weight.1.2", "prefix", "prefix.", "prefix.1.2.3", "displayname", "displayname.", "meta", "group.", ""}
+	for _, node := range nodes {
+		rank := &GroupInfo{Title: "Admin", Color: "#FF5555", Weight: 100}
+		applyGroupNode(context.Background(), "admin", rank, node)
+		if rank.Title != "Admin" || rank.Color != "#FF5555" || rank.Weight != 100 {
+			t.Errorf("%q: changed group to %+v", node, *rank)
+		}
+	}
+}
+
+func TestStaffSkipsMalformedGroupPermissions(t *testing.T) {
+	setupStaffTest(t, "admin")
+
+	e, db := newFakeEndpoints(t)
+	staffFixture{
+		permissions: [][]driver.Value{
+			row("group.", "a1b2", "mikroskeem"),
+			row("group.admin.extra", "c3d4", "notch"),
+			row(nil, "e5f6", "jeb_"),
+			row("group.admin", "0a0b", "dinnerbone"),
+		},
+		nodes: [][]driver.Value{
+			row("admin", "prefix"),
+			row("admin", "weight.1.2"),
+			row("admin", "prefix.100.&cAdmin"),
+		},
+	}.answer(db)
+
+	ranks, err := fetchTestStaff(t, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rank := ranks["admin"]
+	if len(rank.Members) != 1 || rank.Members[0].Name != "dinnerbone" {
+		t.Errorf("got members %v, expected only dinnerbone", rank.Members)
+	}
+	if rank.Title != "Admin" || rank.Color != "#FF5555" || rank.Weight != 0 {
+		t.Errorf("got %+v, expected title and color from the valid prefix node", *rank)
+	}
+}
+
+func TestKeepHighestGroupOnly(t *testing.T) {
+	member := func(uuid string) StaffMember {
+		return StaffMember{Name: uuid, UUID: uuid}
+	}
+	ranks := map[string]*GroupInfo{
+		"owner":   {Weight: 100, Members: []StaffMember{member("a")}},
+		"admin":   {Weight: 50, Members: []StaffMember{member("a"), member("b")}},
+		"mod":     {Weight: 10, Members: []StaffMember{member("b"), member("c")}},
+		"builder": {Weight: 10, Members: []StaffMember{member("c"), member("d")}},
+		"helper":  {Weight: 5, Members: []StaffMember{member("a")}},
+	}
+
+	keepHighestGroupOnly(ranks)
+
+	// Equal weights go to the group whose name sorts first
+	expected := map[string][]string{
+		"owner":   {"a"},
+		"admin":   {"b"},
+		"builder": {"c", "d"},
+	}
+	if len(ranks) != len(expected) {
+		t.Errorf("got groups %v, expected %v", ranks, expected)
+	}
+	for rankName, uuids := range expected {
+		rank, ok := ranks[rankName]
+		if !ok {
+			t.Errorf("group %q was dropped", rankName)
+			continue
+		}
+		var got []string
+		for _, m := range rank.Members {
+			got = append(got, m.UUID)
+		}
+		if strings.Join(got, ",") != strings.Join(uuids, ",") {
+			t.Errorf("%s: got members %v, expected %v", rankName, got, uuids)
+		}
+	}
+}
+
+func TestHeadStaffWithoutCacheSkipsStaffQueries(t *testing.T) {
+	setupStaffTest(t, "admin")
+
+	e, db := newFakeEndpoints(t)
+	staffFixture{players: [][]driver.Value{row("a1b2", "mikroskeem", "admin")}}.answer(db)
+
+	w := httptest.NewRecorder()
+	e.HandleStaff(w, httptest.NewRequest("HEAD", "/api/v1/staff", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected 200", w.Code)
+	}
+	if queries := db.ran(""); len(queries) != 0 {
+		t.Errorf("HEAD ran %d staff queries, expected none", len(queries))
+	}
+}
+
+func TestMalformedNodeWarningHasRequestID(t *testing.T) {
+	logs := observeLogs(t)
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "test-request")
+
+	applyGroupNode(ctx, "admin", &GroupInfo{}, "weight.1.2")
+
+	entries := logs.FilterField(zap.String("requestID", "test-request")).All()
+	if len(entries) != 1 {
+		t.Errorf("got %d log entries with request ID, expected 1 of %d", len(entries), logs.Len())
+	}
+}
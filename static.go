@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Serves a single-page frontend from a directory. Unknown paths get index.html, so that
+// frontend routing works on reload
+type spaHandler struct {
+	dir        string
+	fs         http.FileSystem
+	fileServer http.Handler
+}
+
+func newSPAHandler(dir string) spaHandler {
+	fs := spaFileSystem{http.Dir(dir)}
+	return spaHandler{
+		dir:        dir,
+		fs:         fs,
+		fileServer: http.FileServer(fs),
+	}
+}
+
+func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file, err := h.fs.Open(path.Clean("/" + r.URL.Path))
+	if os.IsNotExist(err) {
+		http.ServeFile(w, r, filepath.Join(h.dir, "index.html"))
+		return
+	} else if err == nil {
+		file.Close()
+	}
+
+	h.fileServer.ServeHTTP(w, r)
+}
+
+// Hides directories without index.html, which file server would otherwise list
+type spaFileSystem struct {
+	http.FileSystem
+}
+
+func (fs spaFileSystem) Open(name string) (http.File, error) {
+	file, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		index, err := fs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			file.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return file, nil
+}
+
+// Keeps frontend route away from API paths, so that unknown ones get the JSON 404 and known ones
+// called with a wrong method get 405
+func isFrontendPath(r *http.Request, _ *mux.RouteMatch) bool {
+	return !strings.HasPrefix(r.URL.Path, "/api/")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Router with an API route and the frontend registered the same way as in main
+func newStaticTestRouter(t *testing.T) *mux.Router {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":        "frontend",
+		"assets/app.js":     "script",
+		"docs/index.html":   "docs",
+		"images/.gitignore": "",
+	}
+	for name, content := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/api/v1/batch", func(w http.ResponseWriter, r *http.Request) {}).Methods(http.MethodPost)
+	router.PathPrefix("/").MatcherFunc(isFrontendPath).Handler(newSPAHandler(dir)).Methods(http.MethodGet, http.MethodHead)
+	router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(handleMethodNotAllowed)
+	return router
+}
+
+func TestSPAHandler(t *testing.T) {
+	router := newStaticTestRouter(t)
+
+	cases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "frontend"},
+		{"/assets/app.js", http.StatusOK, "script"},
+		{"/docs/", http.StatusOK, "docs"},
+		{"/leaderboard", http.StatusOK, "frontend"},
+		// Directories without index.html are not listed
+		{"/images/", http.StatusOK, "frontend"},
+		{"/assets/", http.StatusOK, "frontend"},
+		{"/api/v1/nothing", http.StatusNotFound, `"not found"`},
+		{"/api/v1/batch", http.StatusMethodNotAllowed, `"method not allowed"`},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.body) {
+			t.Errorf("%s: got status %d and body %q, expected %d with %q", c.path, w.Code, w.Body.String(), c.status, c.body)
+		}
+		if strings.Contains(w.Body.String(), ".gitignore") || strings.Contains(w.Body.String(), "app.js") {
+			t.Errorf("%s: got directory listing %q", c.path, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+const statsCacheKey = "stats"
+
+// Vote totals and staff counts in one response, for dashboards
+func (e *Endpoints) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if !checkQueryParams(w, r) {
+		return
+	}
+
+	if cached, ok := e.statsCache.Get(statsCacheKey); ok {
+		writeResponse(w, http.StatusOK, cached)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), config.RestAPI.StaffTimeout.Duration)
+	defer cancel()
+	resultCh := make(chan interface{}, 1)
+
+	// Staff query is only expensive when it's not cached
+	cachedStaff, staffCached := e.staffCache.Get(staffCacheKey)
+	if !staffCached {
+		if !e.acquireHeavyQuery(ctx, w) {
+			return
+		}
+	}
+
+	go func() {
+		defer recoverWorker(ctx, failTo(resultCh))
+		if !staffCached {
+			defer e.releaseHeavyQuery()
+		}
+
+		summaryCh := make(chan interface{}, 1)
+		staffCh := make(chan interface{}, 1)
+
+		go func() {
+			defer recoverWorker(ctx, failTo(summaryCh))
+
+			if summary, err := e.fetchVotesSummary(ctx); err != nil {
+				summaryCh <- err
+			} else {
+				summaryCh <- summary
+			}
+		}()
+
+		if staffCached {
+			staffCh <- cachedStaff
+		} else {
+			go e.fetchStaff(ctx, staffCh)
+		}
+
+		// Wait for both before checking errors, so neither goroutine is left behind
+		summaryResult := <-summaryCh
+		staffResult := <-staffCh
+		if err, ok := summaryResult.(error); ok {
+			resultCh <- err
+			return
+		}
+		if err, ok := staffResult.(error); ok {
+			resultCh <- err
+			return
+		}
+
+		summary := summaryResult.(VotesSummary)
+		ranks := staffResult.(map[string]*GroupInfo)
+		if !staffCached && !isPartialStaff(ranks) {
+			e.staffCache.Set(staffCacheKey, ranks)
+		}
+
+		members := map[string]bool{}
+		for _, rank := range ranks {
+			for _, member := range rank.Members {
+				members[member.UUID] = true
+			}
+		}
+
+		resultCh <- Stats{
+			TotalVotes:   summary.TotalVotes,
+			TotalVoters:  summary.TotalVoters,
+			StaffGroups:  len(ranks),
+			StaffMembers: len(members),
+		}
+	}()
+
+	select {
+	case result := <-resultCh:
+		if err, ok := result.(error); ok {
+			writeError(ctx, w, err, "failed to fetch stats", "database access error")
+		} else {
+			e.statsCache.Set(statsCacheKey, result)
+			writeResponse(w, http.StatusOK, result)
+		}
+	case <-ctx.Done():
+		writeContextError(ctx, w)
+	}
+}
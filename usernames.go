@@ -0,0 +1,37 @@
+package main
+
+import "fmt"
+
+// Values of username_source, telling where original casing of usernames comes from
+const (
+	usernameSourceBenjiAuth = "benjiauth"
+	usernameSourceLuckPerms = "luckperms" // Lowercase LuckPerms usernames are used as is
+	usernameSourceAuthMe    = "authme"
+)
+
+// Table mapping lowercase usernames to their original casing
+type usernameTable struct {
+	table          string // As "database.table"
+	nameColumn     string
+	originalColumn string
+}
+
+// Returns where to look up original usernames from, or false when usernames are not looked up
+func usernameLookup() (usernameTable, bool) {
+	switch config.Database.UsernameSource {
+	case usernameSourceLuckPerms:
+		return usernameTable{}, false
+	case usernameSourceAuthMe:
+		return usernameTable{
+			table:          fmt.Sprintf("%s.%s", config.Database.AuthMeDatabaseName, config.Database.AuthMeTableName),
+			nameColumn:     config.Database.AuthMeNameColumn,
+			originalColumn: config.Database.AuthMeRealNameColumn,
+		}, true
+	default:
+		return usernameTable{
+			table:          fmt.Sprintf("%s.%s", config.Database.BenjiAuthDatabaseName, config.Database.BenjiAuthUsersTableName),
+			nameColumn:     "username",
+			originalColumn: "original_username",
+		}, true
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Allowed values of "sort" query parameter mapped to order by clauses
+var voterOrderings = map[string]string{
+	"votes":  "votes desc",
+	"recent": "last_vote_timestamp desc",
+}
+
+// Parsed query parameters of votes endpoint
+type votersQuery struct {
+	orderBy string
+	limit   int // -1 when unlimited
+	offset  int
+	plain   bool // Older clients expect plain array of voters
+	format  string
+
+	minVotes int
+	since    int64  // Unix timestamp in seconds, 0 when not filtering
+	asOf     int64  // Unix timestamp in seconds, 0 for current totals
+	search   string // Literal substring of voter name, empty when not searching
+}
+
+func parseVotersQuery(r *http.Request) (*votersQuery, error) {
+	query := &votersQuery{
+		orderBy: voterOrderings["votes"],
+		limit:   -1,
+	}
+
+	if sortStr := r.URL.Query().Get("sort"); sortStr != "" {
+		if ordering, ok := voterOrderings[sortStr]; ok {
+			query.orderBy = ordering
+		} else {
+			return nil, fmt.Errorf("invalid sort: %s", sortStr)
+		}
+	}
+
+	if config.RestAPI.DefaultVotersLimit > 0 {
+		query.limit = config.RestAPI.DefaultVotersLimit
+	}
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if num, err := strconv.Atoi(limitStr); err == nil && num > 0 {
+			query.limit = num
+		} else {
+			return nil, fmt.Errorf("invalid limit: %s", limitStr)
+		}
+	}
+	if maxLimit := config.RestAPI.MaxVotersLimit; maxLimit > 0 && (query.limit == -1 || query.limit > maxLimit) {
+		query.limit = maxLimit
+	}
+
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		if num, err := strconv.Atoi(offsetStr); err == nil && num >= 0 {
+			query.offset = num
+		} else {
+			return nil, fmt.Errorf("invalid offset: %s", offsetStr)
+		}
+	}
+
+	if minVotesStr := r.URL.Query().Get("min_votes"); minVotesStr != "" {
+		if num, err := strconv.Atoi(minVotesStr); err == nil && num >= 0 {
+			query.minVotes = num
+		} else {
+			return nil, fmt.Errorf("invalid min_votes: %s", minVotesStr)
+		}
+	}
+
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		if num, err := strconv.ParseInt(sinceStr, 10, 64); err == nil && num >= 0 {
+			query.since = num
+		} else {
+			return nil, fmt.Errorf("invalid since: %s", sinceStr)
+		}
+	}
+
+	if periodStr := r.URL.Query().Get("period"); periodStr != "" {
+		start, ok := periodStart(periodStr, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("invalid period: %s", periodStr)
+		}
+		if !start.IsZero() && start.Unix() > query.since {
+			query.since = start.Unix()
+		}
+	}
+
+	if asOfStr := r.URL.Query().Get("as_of"); asOfStr != "" {
+		if config.Database.ConfettiEventsTable == "" {
+			return nil, errors.New("as_of is not available, votes table only keeps running totals")
+		}
+		if num, err := strconv.ParseInt(asOfStr, 10, 64); err == nil && num > 0 {
+			query.asOf = num
+		} else {
+			return nil, fmt.Errorf("invalid as_of: %s", asOfStr)
+		}
+	}
+
+	// Confetti stores usernames in lowercase
+	query.search = strings.ToLower(r.URL.Query().Get("search"))
+
+	query.plain = r.URL.Query().Get("plain") == "true"
+
+	var err error
+	if query.format, err = negotiateFormat(r); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+// Identifies cached results of this query. Includes every parameter affecting returned voters,
+// but not format, as CSV and JSON are rendered from the same result
+func (q *votersQuery) cacheKey() string {
+	return fmt.Sprintf("order=%s limit=%d offset=%d plain=%t min_votes=%d since=%d as_of=%d search=%q",
+		q.orderBy, q.limit, q.offset, q.plain, q.minVotes, q.since, q.asOf, q.search)
+}
+
+// Returns table to select voters from. With as_of, totals are counted from vote events up to that time
+func (q *votersQuery) sourceSQL() (string, []interface{}) {
+	if q.asOf == 0 {
+		return votesTableSQL("voters"), nil
+	}
+
+	// Same seconds or milliseconds guess as voteTime, covering the whole as_of second
+	return fmt.Sprintf("(select %[2]s as voter_name, count(*) as votes, max(%[3]s) as last_vote_timestamp from %[1]s "+
+			"where %[3]s <= if(%[3]s > 100000000000, ? * 1000 + 999, ?) group by %[2]s) as snapshot",
+			config.Database.ConfettiEventsTable,
+			config.Database.ConfettiEventsVoterColumn,
+			config.Database.ConfettiEventsTimestampColumn),
+		[]interface{}{q.asOf, q.asOf}
+}
+
+// Returns votes table aliased as alias, with duplicate voter_name rows collapsed into one unless
+// raw_voter_rows is enabled
+func votesTableSQL(alias string) string {
+	table := fmt.Sprintf("%s.%s", config.Database.ConfettiDatabaseName, config.Database.ConfettiVotesTableName)
+	if config.Database.RawVoterRows {
+		return table + " " + alias
+	}
+	var streakColumns string
+	for _, column := range []string{config.Database.ConfettiCurrentStreakColumn, config.Database.ConfettiBestStreakColumn} {
+		if column != "" {
+			streakColumns += fmt.Sprintf(", max(%[1]s) as %[1]s", column)
+		}
+	}
+	return fmt.Sprintf("(select voter_name, sum(votes) as votes, max(last_vote_timestamp) as last_vote_timestamp%s "+
+		"from %s group by voter_name) as %s", streakColumns, table, alias)
+}
+
+// Returns current and best streak columns of votes table, null for ones not configured. Snapshots
+// of past votes have no streaks
+func (q *votersQuery) streakSQL() string {
+	currentStreak, bestStreak := "null", "null"
+	if q.asOf == 0 && config.Database.ConfettiCurrentStreakColumn != "" {
+		currentStreak = config.Database.ConfettiCurrentStreakColumn
+	}
+	if q.asOf == 0 && config.Database.ConfettiBestStreakColumn != "" {
+		bestStreak = config.Database.ConfettiBestStreakColumn
+	}
+	return currentStreak + ", " + bestStreak
+}
+
+// Builds where clause for min_votes, since and search filters, empty when not filtering
+func (q *votersQuery) whereSQL() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if q.minVotes > 0 {
+		conditions = append(conditions, "votes >= ?")
+		args = append(args, q.minVotes)
+	}
+	if q.since > 0 {
+		// Same seconds or milliseconds guess as voteTime
+		conditions = append(conditions, "last_vote_timestamp >= if(last_vote_timestamp > 100000000000, ? * 1000, ?)")
+		args = append(args, q.since, q.since)
+	}
+
+	if q.search != "" {
+		// Explicit escape character, as backslash depends on NO_BACKSLASH_ESCAPES sql mode
+		conditions = append(conditions, "voter_name like ? escape '!'")
+		args = append(args, "%"+escapeLike(q.search)+"%")
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "where " + strings.Join(conditions, " and "), args
+}
+
+// Escapes LIKE wildcards with "!", so that "a_b" only matches itself and not "axb"
+func escapeLike(value string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value)
+}
+
+// Returns start of the current day, week (starting on Monday) or month in display timezone.
+// Period "all" yields zero time. Returns false for unknown periods
+func periodStart(period string, now time.Time) (time.Time, bool) {
+	year, month, day := now.In(displayLocation).Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, displayLocation)
+
+	switch period {
+	case "day":
+		return today, true
+	case "week":
+		daysSinceMonday := (int(today.Weekday()) + 6) % 7
+		return today.AddDate(0, 0, -daysSinceMonday), true
+	case "month":
+		return time.Date(year, month, 1, 0, 0, 0, 0, displayLocation), true
+	case "all":
+		return time.Time{}, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (q *votersQuery) countSQL() (string, []interface{}) {
+	source, args := q.sourceSQL()
+	where, whereArgs := q.whereSQL()
+	return fmt.Sprintf("select count(*) from %s %s;", source, where), append(args, whereArgs...)
+}
+
+func (q *votersQuery) selectSQL() (string, []interface{}) {
+	var limitStr string
+	if q.limit != -1 {
+		limitStr = fmt.Sprintf("limit %d offset %d", q.limit, q.offset)
+	} else if q.offset > 0 {
+		// MySQL does not support offset without limit
+		limitStr = fmt.Sprintf("limit 18446744073709551615 offset %d", q.offset)
+	}
+
+	// Pls no bully but prepared statements are not needed for ordering and limits - not handling user input, technically
+	source, args := q.sourceSQL()
+	where, whereArgs := q.whereSQL()
+	return fmt.Sprintf("select voter_name, votes, last_vote_timestamp, %s, %s from %s %s order by %s %s;",
+		q.streakSQL(),
+		avatarUUIDSQL(),
+		source,
+		where,
+		q.orderBy,
+		limitStr), append(args, whereArgs...)
+}
+
+// Returns BenjiAuth UUID of the voter when avatar URLs are enabled, null otherwise
+func avatarUUIDSQL() string {
+	if config.RestAPI.AvatarURLTemplate == "" || config.Database.BenjiAuthUUIDColumn == "" {
+		return "null"
+	}
+	return fmt.Sprintf("(select %s from %s.%s where username = voter_name)",
+		config.Database.BenjiAuthUUIDColumn,
+		config.Database.BenjiAuthDatabaseName,
+		config.Database.BenjiAuthUsersTableName)
+}
+
+func (q *votersQuery) pagination(returned int, total int) Pagination {
+	pagination := Pagination{
+		Offset:  q.offset,
+		Total:   total,
+		HasMore: q.offset+returned < total,
+	}
+	if q.limit != -1 {
+		pagination.Limit = q.limit
+	}
+	return pagination
+}
+
+func scanVoter(rows *sql.Rows) (VoterInfo, error) {
+	voter := VoterInfo{}
+	var uuid sql.NullString
+	err := rows.Scan(&(voter.Username), &(voter.Votes), &(voter.Timestamp), &(voter.CurrentStreak), &(voter.BestStreak), &uuid)
+	completeVoter(&voter, uuid)
+	return voter, err
+}
+
+// Fills fields of a scanned voter derived from its columns
+func completeVoter(voter *VoterInfo, uuid sql.NullString) {
+	voter.NextMilestone, voter.VotesToNext = milestoneProgress(voter.Votes)
+	if uuid.Valid {
+		voter.AvatarURL = strings.ReplaceAll(config.RestAPI.AvatarURLTemplate, "{uuid}", normalizeUUID(uuid.String))
+	}
+}
+
+// Sends either VoterList or VotersPage, depending on query, or an error to resultCh
+func (e *Endpoints) fetchVoters(ctx context.Context, query *votersQuery, resultCh chan<- interface{}) {
+	defer recoverWorker(ctx, failTo(resultCh))
+
+	var total int
+	if !query.plain {
+		countSQL, countArgs := query.countSQL()
+		if err := e.queryRow(ctx, "votes_count", countSQL, countArgs...).Scan(&total); err != nil {
+			resultCh <- err
+			return
+		}
+	}
+
+	selectSQL, selectArgs := query.selectSQL()
+	rows, err := e.query(ctx, "votes", selectSQL, selectArgs...)
+	if err != nil {
+		resultCh <- err
+		return
+	}
+	defer rows.Close()
+
+	// Rows are converted inline. Reading them is serial anyway, and BenchmarkVoterRows shows that
+	// the work after Scan takes about half of the time per row, so even a pool on many cores would at
+	// most halve this loop, while on a single core it is no faster. Large results are mostly streamed
+	// instead, which converts rows one at a time as they are written
+	voters := VoterList{}
+	for rows.Next() {
+		voter, err := scanVoter(rows)
+		if err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+		voters = append(voters, voter)
+	}
+
+	if query.plain {
+		resultCh <- voters
+		return
+	}
+
+	resultCh <- VotersPage{
+		Voters:     voters,
+		Pagination: query.pagination(len(voters), total),
+	}
+}
+
+// Database rows of a streamed votes response, once their query has started
+type votersStream struct {
+	rows  *sql.Rows
+	total int
+}
+
+// Writes voters straight from database rows into the response without collecting them in memory
+// first, as the whole votes table could be huge. Used for JSON GET requests without limit. Streamed
+// responses have no Content-Length and ETag, as the body size is not known upfront.
+//
+// voters_timeout only bounds getting the query started. Rows are then streamed for as long as the
+// client keeps reading them, bound by the request context and server write timeout, as cutting the
+// response off midway would leave the client with broken JSON
+func (e *Endpoints) streamVoters(w http.ResponseWriter, r *http.Request, query *votersQuery) {
+	ctx, cancelStream := context.WithCancel(r.Context())
+	defer cancelStream()
+	startCtx, cancelStart := context.WithTimeout(ctx, config.RestAPI.VotersTimeout.Duration)
+	defer cancelStart()
+	resultCh := make(chan interface{}, 1)
+
+	go func() {
+		defer recoverWorker(ctx, failTo(resultCh))
+
+		var total int
+		if !query.plain {
+			countSQL, countArgs := query.countSQL()
+			if err := e.queryRow(ctx, "votes_count", countSQL, countArgs...).Scan(&total); err != nil {
+				resultCh <- err
+				return
+			}
+		}
+
+		selectSQL, selectArgs := query.selectSQL()
+		rows, err := e.query(ctx, "votes", selectSQL, selectArgs...)
+		if err != nil {
+			resultCh <- err
+			return
+		}
+		resultCh <- votersStream{rows, total}
+	}()
+
+	var stream votersStream
+	select {
+	case result := <-resultCh:
+		if err, ok := result.(error); ok {
+			writeError(startCtx, w, err, "failed to fetch votes", "database access error")
+			return
+		}
+		stream = result.(votersStream)
+	case <-startCtx.Done():
+		// Aborts the query. Rows returned after all are closed by database/sql along with their context
+		cancelStream()
+		writeContextError(startCtx, w)
+		return
+	}
+
+	rows, total := stream.rows, stream.total
+	defer rows.Close()
+
+	setCommonHeaders(w, "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	buf := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buf)
+	relative := wantsRelative(r)
+
+	// Envelope is written by hand around the streamed array
+	raw := isRawResponse(w)
+	if !raw {
+		fmt.Fprintf(buf, `{"status":"%s","data":`, okStatus)
+	}
+	if !query.plain {
+		buf.WriteString(`{"voters":`)
+	}
+	buf.WriteString("[")
+
+	count := 0
+	for rows.Next() {
+		voter, err := scanVoter(rows)
+		if err != nil {
+			logger(ctx).Warn("failed to scan row", zap.Error(err))
+			continue
+		}
+
+		if relative {
+			voter.setRelative(time.Now())
+		}
+
+		if count > 0 {
+			buf.WriteString(",")
+		}
+		encoder.Encode(voter)
+		count++
+	}
+
+	if err := rows.Err(); err != nil {
+		logger(ctx).Error("failed to stream votes", zap.Error(err))
+		// Status is already sent, so abort the connection instead of letting client
+		// mistake truncated response for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	buf.WriteString("]")
+	if !query.plain {
+		buf.WriteString(`,"pagination":`)
+		encoder.Encode(query.pagination(count, total))
+		buf.WriteString("}")
+	}
+	if !raw {
+		buf.WriteString("}")
+	}
+	buf.WriteString("\n")
+	buf.Flush()
+}
+
+// Vote timestamps may be stored either in seconds or milliseconds
+func voteTime(timestamp uint64) time.Time {
+	if timestamp > 1e11 {
+		return time.Unix(0, int64(timestamp)*int64(time.Millisecond))
+	}
+	return time.Unix(int64(timestamp), 0)
+}
+
+// Votes result as kept in votes cache, along with its Last-Modified time
+type cachedVoters struct {
+	voters       interface{}
+	lastModified time.Time
+}
+
+// Returns time of the most recent vote among returned voters, zero when there are none. Historical
+// (as_of) results only hold votes up to that time, so their validator does not move with new votes
+func votersLastModified(voters interface{}) time.Time {
+	var list VoterList
+	switch voters := voters.(type) {
+	case VoterList:
+		list = voters
+	case VotersPage:
+		list = voters.Voters
+	}
+
+	var lastModified time.Time
+	for _, voter := range list {
+		if voted := voteTime(voter.Timestamp); voted.After(lastModified) {
+			lastModified = voted
+		}
+	}
+	return lastModified
+}
+
+// Sets Last-Modified and answers with 304 if client already has a response as recent. Returns false if
+// response is already written. Votes moving voters between pages don't always touch the page's most recent
+// vote, so clients should prefer If-None-Match with the ETag of buffered responses, which writeBody checks.
+// Streamed responses have no ETag, leaving Last-Modified as their only validator
+func checkVotesModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+	if lastModified.IsZero() {
+		return true
+	}
+
+	// HTTP dates have second precision
+	lastModified = lastModified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		setCommonHeaders(w, "application/json")
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+
+	return true
+}
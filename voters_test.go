@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var voterColumns = []string{"voter_name", "votes", "last_vote_timestamp", "current_streak", "best_streak", "uuid"}
+
+func voterRow(name string, votes int64, timestamp int64) []driver.Value {
+	return row(name, votes, timestamp, nil, nil, nil)
+}
+
+func TestVotersLastModified(t *testing.T) {
+	voters := VoterList{
+		{Username: "a", Timestamp: 1590000000},
+		// Milliseconds
+		{Username: "b", Timestamp: 1590000100000},
+		{Username: "c", Timestamp: 1590000050},
+	}
+
+	expected := time.Unix(1590000100, 0)
+	if got := votersLastModified(voters); !got.Equal(expected) {
+		t.Errorf("got %v for list, expected %v", got, expected)
+	}
+	if got := votersLastModified(VotersPage{Voters: voters}); !got.Equal(expected) {
+		t.Errorf("got %v for page, expected %v", got, expected)
+	}
+	if got := votersLastModified(VoterList{}); !got.IsZero() {
+		t.Errorf("got %v for no voters, expected zero time", got)
+	}
+}
+
+func TestCheckVotesModified(t *testing.T) {
+	lastModified := time.Unix(1590000000, 500*int64(time.Millisecond))
+
+	cases := []struct {
+		name            string
+		ifModifiedSince string
+		lastModified    time.Time
+		expectWrite     bool
+	}{
+		{"no validator", "", lastModified, true},
+		{"same second", "Wed, 20 May 2020 18:40:00 GMT", lastModified, false},
+		{"newer vote", "Wed, 20 May 2020 18:39:59 GMT", lastModified, true},
+		{"no votes", "Wed, 20 May 2020 18:40:00 GMT", time.Time{}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/votes", nil)
+			if c.ifModifiedSince != "" {
+				r.Header.Set("If-Modified-Since", c.ifModifiedSince)
+			}
+			w := httptest.NewRecorder()
+
+			if write := checkVotesModified(w, r, c.lastModified); write != c.expectWrite {
+				t.Fatalf("got %t, expected %t", write, c.expectWrite)
+			}
+			if !c.expectWrite && w.Code != http.StatusNotModified {
+				t.Errorf("got status %d, expected 304", w.Code)
+			}
+			if !c.lastModified.IsZero() && w.Header().Get("Last-Modified") != "Wed, 20 May 2020 18:40:00 GMT" {
+				t.Errorf("got Last-Modified %q", w.Header().Get("Last-Modified"))
+			}
+		})
+	}
+}
+
+func TestVotersIfNoneMatch(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.VotersTimeout = duration{time.Second}
+
+	e, db := newFakeEndpoints(t)
+	db.answer("select count(*)", []string{"count(*)"}, row(int64(1)))
+	db.answer("select voter_name", voterColumns, voterRow("a", 1, 1590000000))
+	handler := encoderMiddleware(http.HandlerFunc(e.HandleVoters))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/votes?limit=10", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q, expected 200 with ETag", w.Code, etag)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/votes?limit=10", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got status %d with %d byte body, expected empty 304", w.Code, w.Body.Len())
+	}
+}
+
+func TestStreamVotersOutlastsVotersTimeout(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.VotersTimeout = duration{50 * time.Millisecond}
+
+	e, db := newFakeEndpoints(t)
+	db.answer("select count(*)", []string{"count(*)"}, row(int64(5)))
+	votes := db.answer("select voter_name", voterColumns,
+		voterRow("a", 5, 1590000000),
+		voterRow("b", 4, 1590000000),
+		voterRow("c", 3, 1590000000),
+		voterRow("d", 2, 1590000000),
+		voterRow("e", 1, 1590000000))
+	// Reading all rows takes twice the voters timeout
+	votes.rowDelay = 20 * time.Millisecond
+
+	w := httptest.NewRecorder()
+	e.HandleVoters(w, httptest.NewRequest("GET", "/api/v1/votes", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected 200", w.Code)
+	}
+	if w.Header().Get("ETag") != "" || w.Header().Get("Content-Length") != "" {
+		t.Error("expected streamed response without ETag and Content-Length")
+	}
+
+	var response struct {
+		Data VotersPage `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("got broken JSON %q: %v", w.Body.String(), err)
+	}
+	if len(response.Data.Voters) != 5 || response.Data.Pagination.Total != 5 {
+		t.Errorf("got %+v, expected all 5 voters", response.Data)
+	}
+}
+
+func TestStreamVotersQueryStartTimesOut(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.VotersTimeout = duration{20 * time.Millisecond}
+
+	e, db := newFakeEndpoints(t)
+	db.answer("select count(*)", []string{"count(*)"}, row(int64(1)))
+	db.answer("select voter_name", voterColumns, voterRow("a", 1, 1590000000)).delay = time.Second
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	e.HandleVoters(w, httptest.NewRequest("GET", "/api/v1/votes", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got status %d, expected 504", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("took %v, expected query to be given up at voters timeout", elapsed)
+	}
+}
+
+func TestHeadVotersWithoutLimitIsNotStreamed(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.VotersTimeout = duration{time.Second}
+
+	e, db := newFakeEndpoints(t)
+	// HEAD runs the full query only when its result gets cached
+	e.votersCache = newResponseCache("votes", time.Minute, 0)
+	db.answer("select count(*)", []string{"count(*)"}, row(int64(1)))
+	db.answer("select voter_name", voterColumns, voterRow("a", 1, 1590000000))
+
+	w := httptest.NewRecorder()
+	e.HandleVoters(w, httptest.NewRequest("HEAD", "/api/v1/votes", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected 200", w.Code)
+	}
+	if w.Header().Get("ETag") == "" || w.Header().Get("Content-Length") == "" {
+		t.Error("expected HEAD response with ETag and Content-Length")
+	}
+}
+
+func TestHeadVotersWithoutCacheRunsCheapQuery(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.VotersTimeout = duration{time.Second}
+
+	e, db := newFakeEndpoints(t)
+	db.answer("select max(last_vote_timestamp)", []string{"max(last_vote_timestamp)"}, row(int64(1590000000)))
+
+	w := httptest.NewRecorder()
+	e.HandleVoters(w, httptest.NewRequest("HEAD", "/api/v1/votes?limit=10", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected 200", w.Code)
+	}
+	if lastModified := w.Header().Get("Last-Modified"); lastModified != time.Unix(1590000000, 0).UTC().Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q", lastModified)
+	}
+	if w.Header().Get("ETag") != "" || w.Header().Get("Content-Length") != "" {
+		t.Error("got ETag or Content-Length without rendering the body")
+	}
+	if queries := db.ran("order by"); len(queries) != 0 {
+		t.Errorf("full votes query ran for HEAD: %s", queries[0].sql)
+	}
+
+	r := httptest.NewRequest("HEAD", "/api/v1/votes?limit=10", nil)
+	r.Header.Set("If-Modified-Since", time.Unix(1590000000, 0).UTC().Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	e.HandleVoters(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("got status %d, expected 304", w.Code)
+	}
+}
+
+func TestVotesTableSQLCollapsesDuplicates(t *testing.T) {
+	restoreConfig(t)
+	config.Database.ConfettiDatabaseName = "confetti"
+	config.Database.ConfettiVotesTableName = "votes"
+
+	grouped := votesTableSQL("voters")
+	for _, part := range []string{"sum(votes) as votes", "max(last_vote_timestamp) as last_vote_timestamp", "group by voter_name", ") as voters"} {
+		if !strings.Contains(grouped, part) {
+			t.Errorf("%q does not contain %q", grouped, part)
+		}
+	}
+
+	config.Database.RawVoterRows = true
+	if raw := votesTableSQL("voters"); raw != "confetti.votes voters" {
+		t.Errorf("got %q with raw_voter_rows, expected plain table", raw)
+	}
+}
+
+func TestVotersQueriesUseCollapsedTable(t *testing.T) {
+	restoreConfig(t)
+	config.RestAPI.VotersTimeout = duration{time.Second}
+	config.Database.ConfettiDatabaseName = "confetti"
+	config.Database.ConfettiVotesTableName = "votes"
+
+	e, db := newFakeEndpoints(t)
+	// First matching answer wins, and grouped subqueries contain "select voter_name" too
+	db.answer("select v.voter_name", []string{"voter_name", "votes", "position"}, row("mikroskeem", int64(7), int64(1)))
+	db.answer("select count(*)", []string{"count(*)"}, row(int64(1)))
+	// Both duplicate rows of mikroskeem summed up by the database
+	db.answer("select voter_name", voterColumns, voterRow("mikroskeem", 7, 1590000000))
+
+	w := httptest.NewRecorder()
+	e.HandleVoters(w, httptest.NewRequest("GET", "/api/v1/votes?limit=10", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for votes", w.Code)
+	}
+
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/player/mikroskeem/rank-position", nil), map[string]string{"player": "mikroskeem"})
+	w = httptest.NewRecorder()
+	e.HandlePlayerVotePosition(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d for vote position", w.Code)
+	}
+
+	for _, match := range []string{"select count(*)", "order by", "select v.voter_name"} {
+		for _, query := range db.ran(match) {
+			if strings.Count(query.sql, "group by voter_name") == 0 {
+				t.Errorf("query does not collapse duplicate voters: %s", query.sql)
+			}
+		}
+	}
+	if position := db.ran("select v.voter_name"); len(position) != 1 || strings.Count(position[0].sql, "group by voter_name") != 2 {
+		t.Errorf("vote position is not ranked against collapsed voters: %v", position)
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	cases := map[string]string{
+		"mikroskeem": "mikroskeem",
+		"jeb_":       "jeb!_",
+		"100%":       "100!%",
+		"wow!":       "wow!!",
+		"!_%":        "!!!_!%",
+	}
+	for value, expected := range cases {
+		if escaped := escapeLike(value); escaped != expected {
+			t.Errorf("%q: got %q, expected %q", value, escaped, expected)
+		}
+	}
+}
+
+func TestSearchEscapesWildcards(t *testing.T) {
+	query, err := parseVotersQuery(httptest.NewRequest("GET", "/api/v1/votes?search=jeb_%25", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	where, args := query.whereSQL()
+	if !strings.Contains(where, "voter_name like ? escape '!'") {
+		t.Errorf("search condition lacks escape character: %s", where)
+	}
+	if len(args) != 1 || args[0] != "%jeb!_!%%" {
+		t.Errorf("got args %v, expected [%%jeb!_!%%%%]", args)
+	}
+}
+
+// Converting voter rows inline against scanning them first and completing them in a worker pool
+// with order preserved, which fetchVoters decided against. Run with "go test -run - -bench VoterRows"
+func BenchmarkVoterRows(b *testing.B) {
+	restoreConfig(b)
+	config.RestAPI.VoteMilestones = []int{10, 100, 1000}
+	config.RestAPI.AvatarURLTemplate = "https://crafatar.com/avatars/{uuid}"
+
+	for _, size := range []int{1000, 100000} {
+		e, db := newFakeEndpoints(b)
+		rows := make([][]driver.Value, size)
+		for i := range rows {
+			rows[i] = row(fmt.Sprintf("voter%d", i), int64(i%500), int64(1590000000+i), nil, nil, "069a79f444e94726a5befca90e38aaf5")
+		}
+		db.answer("select voter_name", voterColumns, rows...)
+		ctx := context.Background()
+
+		b.Run(fmt.Sprintf("inline/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rows, err := e.readDB.QueryContext(ctx, "select voter_name")
+				if err != nil {
+					b.Fatal(err)
+				}
+				voters := VoterList{}
+				for rows.Next() {
+					voter, err := scanVoter(rows)
+					if err != nil {
+						b.Fatal(err)
+					}
+					voters = append(voters, voter)
+				}
+				rows.Close()
+			}
+		})
+
+		b.Run(fmt.Sprintf("worker_pool/%d", size), func(b *testing.B) {
+			const workers = 4
+			for i := 0; i < b.N; i++ {
+				rows, err := e.readDB.QueryContext(ctx, "select voter_name")
+				if err != nil {
+					b.Fatal(err)
+				}
+				voters := VoterList{}
+				var uuids []sql.NullString
+				for rows.Next() {
+					var voter VoterInfo
+					var uuid sql.NullString
+					if err := rows.Scan(&(voter.Username), &(voter.Votes), &(voter.Timestamp), &(voter.CurrentStreak), &(voter.BestStreak), &uuid); err != nil {
+						b.Fatal(err)
+					}
+					voters = append(voters, voter)
+					uuids = append(uuids, uuid)
+				}
+				rows.Close()
+
+				// Each worker completes its own chunk in place, keeping the order
+				var wg sync.WaitGroup
+				chunk := (len(voters) + workers - 1) / workers
+				for start := 0; start < len(voters); start += chunk {
+					end := start + chunk
+					if end > len(voters) {
+						end = len(voters)
+					}
+					wg.Add(1)
+					go func(start, end int) {
+						defer wg.Done()
+						for j := start; j < end; j++ {
+							completeVoter(&voters[j], uuids[j])
+						}
+					}(start, end)
+				}
+				wg.Wait()
+			}
+		})
+	}
+}